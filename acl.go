@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IpAccessList decides which clients may connect. A client is denied
+// if its IP is within any of the denied networks, or if there are
+// allowed networks and the IP isn't within any of them.
+type IpAccessList struct {
+	allowed []netip.Prefix
+	denied  []netip.Prefix
+}
+
+// NewIpAccessList parses comma-separated lists of networks in CIDR
+// notation, IPv4 or IPv6. A bare IP means a single address. Returns nil
+// when both lists are empty.
+func NewIpAccessList(allowed string, denied string) (*IpAccessList, error) {
+	l := &IpAccessList{}
+	var err error
+	if l.allowed, err = ParseIpNetworks(allowed); err != nil {
+		return nil, err
+	}
+	if l.denied, err = ParseIpNetworks(denied); err != nil {
+		return nil, err
+	}
+	if len(l.allowed) == 0 && len(l.denied) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+func ParseIpNetworks(s string) ([]netip.Prefix, error) {
+	networks := []netip.Prefix{}
+	for _, network := range strings.Split(s, ",") {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network %q: %s", network, err)
+			}
+			network = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q: %s", network, err)
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
+
+func (l *IpAccessList) Allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	// IPv4 clients of a dual-stack listener look like ::ffff:1.2.3.4.
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range l.denied {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, prefix := range l.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpAccessList(t *testing.T) {
+	l, err := NewIpAccessList("10.0.0.0/8, 192.168.1.10, fd00::/8", "10.1.0.0/16,fd00:dead::/32")
+	require.NoError(t, err)
+
+	assert.True(t, l.Allows("10.0.0.1"))
+	assert.True(t, l.Allows("192.168.1.10"))
+	assert.True(t, l.Allows("::ffff:10.2.0.1"))
+	assert.True(t, l.Allows("fd00::1"))
+	assert.False(t, l.Allows("10.1.2.3"))
+	assert.False(t, l.Allows("192.168.1.11"))
+	assert.False(t, l.Allows("fd00:dead::1"))
+	assert.False(t, l.Allows("2001:db8::1"))
+	assert.False(t, l.Allows("garbage"))
+
+	l, err = NewIpAccessList("", "203.0.113.0/24")
+	require.NoError(t, err)
+	assert.True(t, l.Allows("127.0.0.1"))
+	assert.True(t, l.Allows("::1"))
+	assert.False(t, l.Allows("203.0.113.7"))
+
+	l, err = NewIpAccessList("", "")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	for _, network := range []string{"10.0.0.0/33", "10.0.0", "fd00::/129", "example.com"} {
+		_, err := NewIpAccessList(network, "")
+		assert.Error(t, err, network)
+	}
+}
+
+func TestSmtpAccessListRefusesConnection(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("10.0.0.0/8,::1", "")
+	telegramConfig := makeTelegramConfig()
+	// Not startSmtp, it waits for a successful connection.
+	d, err := SmtpStart(smtpConfig, telegramConfig)
+	require.NoError(t, err)
+	defer d.Shutdown()
+
+	_, err = smtp.Dial(smtpConfig.smtpListen)
+	assert.Equal(t, 554, smtpErrorCode(err))
+}
+
+func TestSmtpAccessListRefusesImplicitTls(t *testing.T) {
+	smtpConfig := makeTlsSmtpConfig(t)
+	smtpConfig.smtpTlsListen = testSmtpTlsListen
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("10.0.0.0/8,::1", "")
+	telegramConfig := makeTelegramConfig()
+	d, err := SmtpStart(smtpConfig, telegramConfig)
+	require.NoError(t, err)
+	defer d.Shutdown()
+	denied := testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED))
+
+	// Closed before the handshake.
+	conn, err := net.Dial("tcp", testSmtpTlsListen)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, denied+1, testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED)))
+}
+
+func TestSmtpAccessListAllowsConnection(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("127.0.0.0/8,::1", "10.0.0.0/8")
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Len(t, h.RequestMessages, 2)
+}
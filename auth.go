@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SmtpCredentials is an htpasswd-style file of the SMTP users:
+//
+//	# user:bcrypt hash[:allowed routes]
+//	alice:$2y$10$...
+//	bob:$2y$10$...:ops@alerts.local,@billing.local
+//
+// The hashes are generated with `htpasswd -nB <user>`. The optional
+// third field is a comma-separated list of the patterns of the routes
+// the user is allowed to send emails to, all recipients are allowed
+// when it's empty. A recipient is allowed when the first route matching
+// it is one of these, the recipients of the default chats are refused.
+//
+// The users are checked by the SMTP front, guerrilla behind it only
+// accepts the sessions relayed by the front.
+//
+// The file is reloaded when it changes.
+type SmtpCredentials struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]*SmtpUser
+	modTime time.Time
+}
+
+type SmtpUser struct {
+	name   string
+	hash   []byte
+	routes []string
+}
+
+// Compared against when the user is unknown, so that it takes as long
+// as a wrong password.
+var smtpDummyHash = []byte("$2a$10$C3icK6fXwv0JOikJTR7YsOOIQFAxfeanMyfOvlfGBCB6Z840R1HBi")
+
+func LoadSmtpCredentials(path string) (*SmtpCredentials, error) {
+	c := &SmtpCredentials{path: path}
+	if err := c.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SmtpCredentials) reloadIfChanged() error {
+	stat, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("Unable to stat SMTP credentials file: %s", err)
+	}
+	if c.users != nil && stat.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read SMTP credentials file: %s", err)
+	}
+	users, err := ParseSmtpCredentials(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.path, err)
+	}
+	c.users = users
+	c.modTime = stat.ModTime()
+	return nil
+}
+
+func ParseSmtpCredentials(data []byte) (map[string]*SmtpUser, error) {
+	users := map[string]*SmtpUser{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected `user:hash`", n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported: %s", n, err)
+		}
+		user := &SmtpUser{name: fields[0], hash: []byte(fields[1]), routes: []string{}}
+		if len(fields) == 3 {
+			for _, pattern := range strings.Split(fields[2], ",") {
+				pattern = strings.TrimSpace(pattern)
+				if pattern == "" {
+					continue
+				}
+				if _, err := CompileAddressPattern(pattern); err != nil {
+					return nil, fmt.Errorf("line %d: %s", n, err)
+				}
+				user.routes = append(user.routes, pattern)
+			}
+		}
+		users[user.name] = user
+	}
+	return users, scanner.Err()
+}
+
+// Authenticate returns the user if the password is correct, nil otherwise.
+func (c *SmtpCredentials) Authenticate(username string, password string) *SmtpUser {
+	c.mu.Lock()
+	if err := c.reloadIfChanged(); err != nil {
+		logger.Errorf("Keeping the previous SMTP credentials: %s", err)
+	}
+	user, ok := c.users[username]
+	c.mu.Unlock()
+
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(smtpDummyHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return nil
+	}
+	return user
+}
+
+// AllowsRoute tells whether the user may send emails to the recipients
+// of the route. The route is nil for the default chats.
+func (u *SmtpUser) AllowsRoute(route *TelegramRoute) bool {
+	if len(u.routes) == 0 {
+		return true
+	}
+	return route != nil && slices.Contains(u.routes, route.pattern)
+}
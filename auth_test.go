@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bcrypt hashes of `alice-secret` and `bob-secret` with the min cost.
+var testSmtpCredentials = "# test users\n" +
+	"alice:$2a$04$vkc5anr8tOH8oroEEkr62O8yxXhlGlHM3awhuPYv.UM8hBi6IQobq\n" +
+	"bob:$2a$04$BdjUCFq7Wed4sOWVfaFlN.yNOfCA.bi.46m/h6McSiLcK0FsV1OwC:ops@alerts.local,@billing.local\n"
+
+func makeAuthSmtpConfig(t *testing.T) *SmtpConfig {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAuthFile = filepath.Join(t.TempDir(), "users")
+	require.NoError(t, os.WriteFile(smtpConfig.smtpAuthFile, []byte(testSmtpCredentials), 0600))
+	return smtpConfig
+}
+
+// loginAuth implements AUTH LOGIN, which is missing in net/smtp.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected challenge: " + string(fromServer))
+}
+
+func smtpErrorCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func TestParseSmtpCredentials(t *testing.T) {
+	users, err := ParseSmtpCredentials([]byte(testSmtpCredentials))
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+	routes := mustParseTelegramRoutes("ops@alerts.local=1;@alerts.local=2;@billing.local=3")
+	assert.True(t, users["alice"].AllowsRoute(nil))
+	assert.True(t, users["alice"].AllowsRoute(routes[1]))
+	assert.True(t, users["bob"].AllowsRoute(routes[0]))
+	assert.True(t, users["bob"].AllowsRoute(routes[2]))
+	assert.False(t, users["bob"].AllowsRoute(routes[1]))
+	assert.False(t, users["bob"].AllowsRoute(nil))
+
+	for _, data := range []string{
+		"alice\n",
+		":$2a$04$vkc5anr8tOH8oroEEkr62O8yxXhlGlHM3awhuPYv.UM8hBi6IQobq\n",
+		"alice:$apr1$Vr2mXqPm$x5CPoNeaImNnKD5MO9wzY0\n",
+		"alice:$2a$04$vkc5anr8tOH8oroEEkr62O8yxXhlGlHM3awhuPYv.UM8hBi6IQobq:/(/\n",
+	} {
+		_, err := ParseSmtpCredentials([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestSmtpAuthRequired(t *testing.T) {
+	smtpConfig := makeAuthSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Equal(t, 530, smtpErrorCode(err))
+
+	// guerrilla doesn't require MAIL before RCPT, the front must.
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, 530, smtpErrorCode(c.Rcpt("to@test")))
+
+	err = smtp.SendMail(smtpConfig.smtpListen, smtp.PlainAuth("", "alice", "wrong", testSmtpListenHost),
+		"from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Equal(t, 535, smtpErrorCode(err))
+	err = smtp.SendMail(smtpConfig.smtpListen, smtp.PlainAuth("", "nobody", "alice-secret", testSmtpListenHost),
+		"from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Equal(t, 535, smtpErrorCode(err))
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestSmtpAuthPlainAndLogin(t *testing.T) {
+	smtpConfig := makeAuthSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, smtp.PlainAuth("", "alice", "alice-secret", testSmtpListenHost),
+		"from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+	err = smtp.SendMail(smtpConfig.smtpListen, &loginAuth{"alice", "alice-secret"},
+		"from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Len(t, h.RequestMessages, 4)
+}
+
+func TestSmtpAuthAllowedRoutes(t *testing.T) {
+	smtpConfig := makeAuthSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes(
+		"ops@billing.local=142;ops@alerts.local=42,142;@billing.local=42")
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	auth := smtp.PlainAuth("", "bob", "bob-secret", testSmtpListenHost)
+	// The default chats.
+	err := smtp.SendMail(smtpConfig.smtpListen, auth, "from@test", []string{"dev@alerts.local"}, []byte(`hi`))
+	assert.Equal(t, 550, smtpErrorCode(err))
+	// Matches the allowed `@billing.local`, but is routed by an earlier route.
+	err = smtp.SendMail(smtpConfig.smtpListen, auth, "from@test", []string{"ops@billing.local"}, []byte(`hi`))
+	assert.Equal(t, 550, smtpErrorCode(err))
+	err = smtp.SendMail(smtpConfig.smtpListen, auth, "from@test", []string{"ops@alerts.local"}, []byte(`hi`))
+	assert.NoError(t, err)
+	err = smtp.SendMail(smtpConfig.smtpListen, auth, "from@test", []string{"invoices@billing.local"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"42", "142", "42"}, h.RequestMessagesFormValues("chat_id"))
+}
+
+func TestSmtpAuthRequiresTlsWhenAvailable(t *testing.T) {
+	smtpConfig := makeAuthSmtpConfig(t)
+	smtpConfig.smtpTlsCertFile, smtpConfig.smtpTlsKeyFile = writeTestCertificate(t, t.TempDir(), "testhost")
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client"))
+	ok, _ := c.Extension("AUTH")
+	assert.False(t, ok)
+	assert.Equal(t, 538, smtpErrorCode(c.Auth(&loginAuth{"alice", "alice-secret"})))
+
+	// net/smtp quits after a failed AUTH.
+	c, err = smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	ok, mechanisms := c.Extension("AUTH")
+	assert.True(t, ok)
+	assert.Equal(t, "PLAIN LOGIN", mechanisms)
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "alice", "alice-secret", testSmtpListenHost)))
+	assert.NoError(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+func TestSmtpAuthNotBypassedThroughBackend(t *testing.T) {
+	smtpConfig := makeAuthSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	// Without AUTH, directly to guerrilla behind the front.
+	c, err := smtp.Dial(d.front.backendAddr)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Error(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 0)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader serves a TLS certificate loaded from the files,
+// reloading it as soon as any of the files changes. This way renewed
+// certificates (e.g. by certbot) are picked up without a restart.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertificateReloader) reloadIfChanged() error {
+	certStat, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("Unable to stat TLS certificate: %s", err)
+	}
+	keyStat, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to stat TLS key: %s", err)
+	}
+	if r.cert != nil &&
+		certStat.ModTime().Equal(r.certModTime) && keyStat.ModTime().Equal(r.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load TLS certificate: %s", err)
+	}
+	r.cert = &cert
+	r.certModTime = certStat.ModTime()
+	r.keyModTime = keyStat.ModTime()
+	return nil
+}
+
+// GetCertificate is suitable for `tls.Config.GetCertificate`.
+// A failed reload is logged and the previous certificate is kept,
+// the files might be in the middle of being replaced.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadIfChanged(); err != nil {
+		logger.Errorf("Keeping the previous TLS certificate: %s", err)
+	}
+	return r.cert, nil
+}
+
+// The interval of checking whether the certificate files have changed
+// for guerrilla, which reloads its certificate only when told so.
+const certificateCheckInterval = time.Second
+
+// WatchCertificateFiles calls `reload` as soon as any of the files
+// changes, until `stop` is closed.
+func WatchCertificateFiles(certFile string, keyFile string, stop chan struct{}, reload func()) {
+	modTimes := func() (time.Time, time.Time) {
+		var certModTime, keyModTime time.Time
+		if stat, err := os.Stat(certFile); err == nil {
+			certModTime = stat.ModTime()
+		}
+		if stat, err := os.Stat(keyFile); err == nil {
+			keyModTime = stat.ModTime()
+		}
+		return certModTime, keyModTime
+	}
+	certModTime, keyModTime := modTimes()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(certificateCheckInterval):
+		}
+		newCertModTime, newKeyModTime := modTimes()
+		if newCertModTime.Equal(certModTime) && newKeyModTime.Equal(keyModTime) {
+			continue
+		}
+		certModTime, keyModTime = newCertModTime, newKeyModTime
+		reload()
+	}
+}
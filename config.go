@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the YAML file passed via `--config`.
+//
+// Its top-level keys are the names of the command line flags, plus
+// the structured sections which cannot be expressed with flags:
+//
+//	smtp-listen: 0.0.0.0:2525
+//	telegram-bot-token: 123:ABC
+//	telegram-chat-ids: [42, 142]
+//	routes:
+//	  - match: ops@alerts.local
+//	    chat_ids: [-1001]
+//	    thread_id: 7
+//	    silent: true
+//	rules:
+//	  - from: ^cron@
+//	    action: drop
+type ConfigFile struct {
+	path   string
+	values map[string]interface{}
+	routes []*TelegramRouteConfig
+	rules  []*TelegramRuleConfig
+}
+
+type TelegramRouteConfig struct {
+	Match   string   `yaml:"match"`
+	ChatIds []string `yaml:"chat_ids"`
+	// The forum topic of the chat ids without `:threadid`.
+	ThreadId int64 `yaml:"thread_id"`
+	// Send the messages without a notification.
+	Silent bool `yaml:"silent"`
+	// Forbid forwarding and saving the messages.
+	ProtectContent bool `yaml:"protect_content"`
+}
+
+// The flags which make no sense in the config file.
+var configFileIgnoredFlags = map[string]bool{
+	"config":  true,
+	"help":    true,
+	"version": true,
+}
+
+func LoadConfigFile(path string, flags []cli.Flag) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s", err)
+	}
+	cf := &ConfigFile{
+		path:   path,
+		values: map[string]interface{}{},
+		routes: []*TelegramRouteConfig{},
+		rules:  []*TelegramRuleConfig{},
+	}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, cf.errorf(0, "%s", err)
+	}
+	if len(root.Content) == 0 {
+		// An empty file
+		return cf, nil
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, cf.errorf(mapping.Line, "expected a mapping of options")
+	}
+
+	flagsByName := map[string]cli.Flag{}
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		if !configFileIgnoredFlags[name] {
+			flagsByName[name] = flag
+		}
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		switch key.Value {
+		case "routes":
+			err = value.Decode(&cf.routes)
+		case "rules":
+			err = value.Decode(&cf.rules)
+		default:
+			flag, ok := flagsByName[key.Value]
+			if !ok {
+				return nil, cf.errorf(key.Line, "unknown option %q", key.Value)
+			}
+			cf.values[key.Value], err = decodeConfigFileValue(flag, value)
+		}
+		if err != nil {
+			return nil, cf.errorf(key.Line, "invalid value of %q: %s", key.Value, trimYamlError(err))
+		}
+	}
+	return cf, nil
+}
+
+func decodeConfigFileValue(flag cli.Flag, node *yaml.Node) (interface{}, error) {
+	switch flag.(type) {
+	case *cli.StringFlag:
+		if node.Kind == yaml.SequenceNode {
+			// Lists, such as chat ids, are comma-separated in the flags.
+			l := []string{}
+			err := node.Decode(&l)
+			return strings.Join(l, ","), err
+		}
+		var s string
+		err := node.Decode(&s)
+		return s, err
+	case *cli.BoolFlag:
+		var b bool
+		err := node.Decode(&b)
+		return b, err
+	case *cli.Float64Flag:
+		var f float64
+		err := node.Decode(&f)
+		return f, err
+	case *cli.UintFlag:
+		var u uint
+		err := node.Decode(&u)
+		return u, err
+	case *cli.DurationFlag:
+		var d time.Duration
+		err := node.Decode(&d)
+		return d, err
+	}
+	return nil, fmt.Errorf("unsupported flag type %T", flag)
+}
+
+func trimYamlError(err error) string {
+	s := strings.TrimPrefix(err.Error(), "yaml: ")
+	s = strings.TrimPrefix(s, "unmarshal errors:\n")
+	return strings.TrimSpace(s)
+}
+
+func (cf *ConfigFile) errorf(line int, format string, args ...interface{}) error {
+	if line > 0 {
+		return fmt.Errorf("%s:%d: %s", cf.path, line, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s: %s", cf.path, fmt.Sprintf(format, args...))
+}
+
+// ConfigSource looks up the option values. The flags and the env vars
+// take precedence over the config file, which takes precedence over
+// the defaults of the flags.
+type ConfigSource struct {
+	c    *cli.Context
+	file *ConfigFile
+}
+
+func (s *ConfigSource) fileValue(name string) (interface{}, bool) {
+	if s.file == nil || s.c.IsSet(name) {
+		return nil, false
+	}
+	v, ok := s.file.values[name]
+	return v, ok
+}
+
+func (s *ConfigSource) String(name string) string {
+	if v, ok := s.fileValue(name); ok {
+		return v.(string)
+	}
+	return s.c.String(name)
+}
+
+func (s *ConfigSource) Bool(name string) bool {
+	if v, ok := s.fileValue(name); ok {
+		return v.(bool)
+	}
+	return s.c.Bool(name)
+}
+
+func (s *ConfigSource) Float64(name string) float64 {
+	if v, ok := s.fileValue(name); ok {
+		return v.(float64)
+	}
+	return s.c.Float64(name)
+}
+
+func (s *ConfigSource) Uint(name string) uint {
+	if v, ok := s.fileValue(name); ok {
+		return v.(uint)
+	}
+	return s.c.Uint(name)
+}
+
+func (s *ConfigSource) Duration(name string) time.Duration {
+	if v, ok := s.fileValue(name); ok {
+		return v.(time.Duration)
+	}
+	return s.c.Duration(name)
+}
+
+func (s *ConfigSource) TelegramRoutes() ([]*TelegramRoute, error) {
+	if s.file == nil || len(s.file.routes) == 0 || s.c.IsSet("telegram-routes") {
+		return ParseTelegramRoutes(s.String("telegram-routes"))
+	}
+	if _, ok := s.file.values["telegram-routes"]; ok {
+		return nil, errors.New("Only one of `telegram-routes` and `routes` can be set in the config file")
+	}
+	routes := []*TelegramRoute{}
+	for i, routeConfig := range s.file.routes {
+		route, err := NewTelegramRoute(routeConfig.Match, WithThreadId(routeConfig.ChatIds, routeConfig.ThreadId))
+		if err != nil {
+			return nil, fmt.Errorf("Route #%d: %s", i+1, err)
+		}
+		route.silent = routeConfig.Silent
+		route.protectContent = routeConfig.ProtectContent
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (s *ConfigSource) TelegramRules() ([]*TelegramRule, error) {
+	if s.file == nil || len(s.file.rules) == 0 || s.c.IsSet("telegram-rules") {
+		return ParseTelegramRules(s.String("telegram-rules"))
+	}
+	if _, ok := s.file.values["telegram-rules"]; ok {
+		return nil, errors.New("Only one of `telegram-rules` and `rules` can be set in the config file")
+	}
+	return NewTelegramRules(s.file.rules)
+}
+
+// LoadConfig builds the configs from the flags, the env vars and
+// the config file.
+func LoadConfig(c *cli.Context) (*SmtpConfig, *TelegramConfig, error) {
+	s := &ConfigSource{c: c}
+	if path := c.String("config"); path != "" {
+		file, err := LoadConfigFile(path, c.App.Flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.file = file
+	}
+
+	smtpMaxEnvelopeSize, err := units.FromHumanSize(s.String("smtp-max-envelope-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	smtpConfig := &SmtpConfig{
+		smtpListen:          s.String("smtp-listen"),
+		smtpPrimaryHost:     s.String("smtp-primary-host"),
+		smtpMaxEnvelopeSize: smtpMaxEnvelopeSize,
+		logLevel:            s.String("log-level"),
+		spoolDir:            s.String("spool-dir"),
+		spoolMaxAge:         s.Duration("spool-max-age"),
+		spoolRetryMinDelay:  s.Duration("spool-retry-min-delay"),
+		spoolRetryMaxDelay:  s.Duration("spool-retry-max-delay"),
+		smtpTlsListen:       s.String("smtp-tls-listen"),
+		smtpTlsCertFile:     s.String("smtp-tls-cert-file"),
+		smtpTlsKeyFile:      s.String("smtp-tls-key-file"),
+		smtpRequireTls:      s.Bool("smtp-require-tls"),
+		smtpAuthFile:        s.String("smtp-auth-file"),
+		httpListen:          s.String("http-listen"),
+		healthCheckInterval: s.Duration("health-check-interval"),
+		healthCheckMaxAge:   s.Duration("health-check-max-age"),
+	}
+	smtpConfig.smtpAccessList, err = NewIpAccessList(
+		s.String("smtp-allowed-networks"), s.String("smtp-denied-networks"))
+	if err != nil {
+		return nil, nil, err
+	}
+	smtpConfig.smtpAcceptedRecipients, err = ParseAcceptedRecipients(s.String("smtp-accepted-recipients"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if (smtpConfig.smtpTlsCertFile == "") != (smtpConfig.smtpTlsKeyFile == "") {
+		return nil, nil, errors.New("Both `smtp-tls-cert-file` and `smtp-tls-key-file` must be set")
+	}
+	if smtpConfig.smtpTlsCertFile == "" && (smtpConfig.smtpTlsListen != "" || smtpConfig.smtpRequireTls) {
+		return nil, nil, errors.New("`smtp-tls-listen` and `smtp-require-tls` require `smtp-tls-cert-file`")
+	}
+	forwardedAttachmentMaxSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	forwardedAttachmentMaxPhotoSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-photo-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	forwardedAttachmentMaxAnimationSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-animation-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	forwardedAttachmentMaxVideoSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-video-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	forwardedAttachmentMaxAudioSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-audio-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	forwardedAttachmentMaxVoiceSize, err := units.FromHumanSize(s.String("forwarded-attachment-max-voice-size"))
+	if err != nil {
+		return nil, nil, err
+	}
+	telegramRoutes, err := s.TelegramRoutes()
+	if err != nil {
+		return nil, nil, err
+	}
+	telegramRules, err := s.TelegramRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch s.String("telegram-startup-check") {
+	case STARTUP_CHECK_FAIL, STARTUP_CHECK_WARN, STARTUP_CHECK_OFF:
+	default:
+		return nil, nil, fmt.Errorf("Unknown `telegram-startup-check` %q", s.String("telegram-startup-check"))
+	}
+	if err := ValidateParseMode(s.String("message-parse-mode")); err != nil {
+		return nil, nil, err
+	}
+	if err := ValidateLongMessageMode(s.String("long-message-mode")); err != nil {
+		return nil, nil, err
+	}
+	if quality := s.Uint("forwarded-attachment-photo-quality"); quality < 1 || quality > 100 {
+		return nil, nil, fmt.Errorf("`forwarded-attachment-photo-quality` must be from 1 to 100, got %d", quality)
+	}
+	if dimension := s.Uint("forwarded-attachment-photo-max-dimension"); dimension != 0 &&
+		(dimension < DOWNSCALE_MIN_DIMENSION || dimension > TELEGRAM_PHOTO_MAX_DIMENSIONS_SUM/2) {
+		return nil, nil, fmt.Errorf("`forwarded-attachment-photo-max-dimension` must be 0 or from %d to %d, got %d",
+			DOWNSCALE_MIN_DIMENSION, TELEGRAM_PHOTO_MAX_DIMENSIONS_SUM/2, dimension)
+	}
+	var messageDateLocation *time.Location
+	if timezone := s.String("message-date-timezone"); timezone != "" {
+		messageDateLocation, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid `message-date-timezone`: %s", err)
+		}
+	}
+	templateEngine := s.String("message-template-engine")
+	if err := ValidateTemplateEngine(templateEngine); err != nil {
+		return nil, nil, err
+	}
+	if err := ValidateMessageTemplate(s.String("message-template"), templateEngine); err != nil {
+		return nil, nil, err
+	}
+	for _, rule := range telegramRules {
+		if err := ValidateMessageTemplate(rule.template, templateEngine); err != nil {
+			return nil, nil, err
+		}
+	}
+	if s.String("telegram-bot-token") == "" {
+		return nil, nil, errors.New("`telegram-bot-token` must be set")
+	}
+	if s.String("telegram-chat-ids") == "" && len(telegramRoutes) == 0 {
+		return nil, nil, errors.New("Either `telegram-chat-ids` or `telegram-routes` must be set")
+	}
+	for _, chatId := range strings.Split(s.String("telegram-chat-ids"), ",") {
+		if chatId = strings.TrimSpace(chatId); chatId != "" {
+			if err := ValidateChatId(chatId); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	telegramConfig := &TelegramConfig{
+		telegramChatIds:                      s.String("telegram-chat-ids"),
+		telegramBotToken:                     s.String("telegram-bot-token"),
+		telegramApiPrefix:                    s.String("telegram-api-prefix"),
+		telegramApiTimeoutSeconds:            s.Float64("telegram-api-timeout-seconds"),
+		messageTemplate:                      s.String("message-template"),
+		messageTemplateEngine:                templateEngine,
+		messageParseMode:                     s.String("message-parse-mode"),
+		messageDateFormat:                    s.String("message-date-format"),
+		messageDateLocation:                  messageDateLocation,
+		forwardedAttachmentMaxSize:           int(forwardedAttachmentMaxSize),
+		forwardedAttachmentMaxPhotoSize:      int(forwardedAttachmentMaxPhotoSize),
+		forwardedAttachmentMaxAnimationSize:  int(forwardedAttachmentMaxAnimationSize),
+		forwardedAttachmentMaxVideoSize:      int(forwardedAttachmentMaxVideoSize),
+		forwardedAttachmentMaxAudioSize:      int(forwardedAttachmentMaxAudioSize),
+		forwardedAttachmentMaxVoiceSize:      int(forwardedAttachmentMaxVoiceSize),
+		forwardedAttachmentPhotoMaxDimension: int(s.Uint("forwarded-attachment-photo-max-dimension")),
+		forwardedAttachmentPhotoQuality:      int(s.Uint("forwarded-attachment-photo-quality")),
+		forwardedAttachmentPhotoSendOriginal: s.Bool("forwarded-attachment-photo-send-original"),
+		forwardedAttachmentRespectErrors:     s.Bool("forwarded-attachment-respect-errors"),
+		messageLengthToSendAsFile:            s.Uint("message-length-to-send-as-file"),
+		longMessageMode:                      s.String("long-message-mode"),
+		telegramRateLimitPerChat:             s.Float64("telegram-rate-limit-per-chat"),
+		telegramRateLimitGlobal:              s.Float64("telegram-rate-limit-global"),
+		telegramFloodMaxWait:                 s.Duration("telegram-flood-max-wait"),
+		telegramRoutes:                       telegramRoutes,
+		telegramRules:                        telegramRules,
+		telegramStartupCheck:                 s.String("telegram-startup-check"),
+	}
+	return smtpConfig, telegramConfig, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func loadTestConfig(t *testing.T, config string, args ...string) (*SmtpConfig, *TelegramConfig, error) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+
+	var smtpConfig *SmtpConfig
+	var telegramConfig *TelegramConfig
+	var err error
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		smtpConfig, telegramConfig, err = LoadConfig(c)
+		return nil
+	}
+	assert.NoError(t, app.Run(append([]string{"smtp_to_telegram", "--config", path}, args...)))
+	return smtpConfig, telegramConfig, err
+}
+
+func TestConfigFile(t *testing.T) {
+	config := `
+smtp-listen: 0.0.0.0:2525
+smtp-max-envelope-size: 1m
+telegram-bot-token: "42:ZZZ"
+telegram-chat-ids: [42, 142]
+telegram-api-timeout-seconds: 5
+forwarded-attachment-respect-errors: true
+message-length-to-send-as-file: 100
+spool-max-age: 1h
+message-template: |
+  Subject: {subject}
+
+  {body}
+routes:
+  - match: ops@alerts.local
+    chat_ids: [-1001, -1002]
+    silent: true
+  - match: "@billing.local"
+    chat_ids: [7, "-1003:5"]
+    thread_id: 3
+    protect_content: true
+rules:
+  - from: ^cron@
+    headers:
+      X-Priority: ^5
+    action: drop
+`
+	smtpConfig, telegramConfig, err := loadTestConfig(t, config)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "0.0.0.0:2525", smtpConfig.smtpListen)
+	assert.Equal(t, int64(1000*1000), smtpConfig.smtpMaxEnvelopeSize)
+	assert.Equal(t, time.Hour, smtpConfig.spoolMaxAge)
+	assert.Equal(t, 10*time.Second, smtpConfig.spoolRetryMinDelay)
+	assert.Equal(t, "42:ZZZ", telegramConfig.telegramBotToken)
+	assert.Equal(t, "42,142", telegramConfig.telegramChatIds)
+	assert.Equal(t, 5.0, telegramConfig.telegramApiTimeoutSeconds)
+	assert.Equal(t, true, telegramConfig.forwardedAttachmentRespectErrors)
+	assert.Equal(t, uint(100), telegramConfig.messageLengthToSendAsFile)
+	assert.Equal(t, "Subject: {subject}\n\n{body}\n", telegramConfig.messageTemplate)
+	assert.Len(t, telegramConfig.telegramRoutes, 2)
+	assert.Equal(t, []string{"-1001", "-1002"}, telegramConfig.telegramRoutes[0].chatIds)
+	assert.Equal(t, []string{"7:3", "-1003:5"}, telegramConfig.telegramRoutes[1].chatIds)
+	assert.Equal(t, true, telegramConfig.telegramRoutes[0].silent)
+	assert.Equal(t, false, telegramConfig.telegramRoutes[0].protectContent)
+	assert.Equal(t, true, telegramConfig.telegramRoutes[1].protectContent)
+	assert.Len(t, telegramConfig.telegramRules, 1)
+	assert.Equal(t, RULE_ACTION_DROP, telegramConfig.telegramRules[0].action)
+}
+
+func TestConfigFileIsOverriddenByFlagsAndEnv(t *testing.T) {
+	config := `
+smtp-listen: 0.0.0.0:2525
+telegram-bot-token: "42:ZZZ"
+telegram-chat-ids: 42
+telegram-api-prefix: http://file/
+routes:
+  - match: ops@alerts.local
+    chat_ids: [1]
+`
+	t.Setenv("ST_TELEGRAM_API_PREFIX", "http://env/")
+	smtpConfig, telegramConfig, err := loadTestConfig(
+		t, config,
+		"--smtp-listen", "127.0.0.1:25",
+		"--telegram-routes", "billing@alerts.local=2",
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "127.0.0.1:25", smtpConfig.smtpListen)
+	assert.Equal(t, "http://env/", telegramConfig.telegramApiPrefix)
+	assert.Equal(t, "42", telegramConfig.telegramChatIds)
+	assert.Len(t, telegramConfig.telegramRoutes, 1)
+	assert.Equal(t, []string{"2"}, telegramConfig.telegramRoutes[0].chatIds)
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{"smtp-listen: [", "config.yaml: yaml: line 1: did not find expected node content"},
+		{"telegram-bot-token: x\nsmtp-lissten: 1", `config.yaml:2: unknown option "smtp-lissten"`},
+		{"telegram-bot-token: x\n\nspool-max-age: forever", `config.yaml:3: invalid value of "spool-max-age"`},
+		{"telegram-bot-token: x\nrules:\n  - action: [1]", `config.yaml:2: invalid value of "rules"`},
+		{"telegram-chat-ids: 42", "`telegram-bot-token` must be set"},
+		{"telegram-bot-token: x", "Either `telegram-chat-ids` or `telegram-routes` must be set"},
+		{"smtp-allowed-networks: [10.0.0.0/8, 10.0.0/8]", `Invalid network "10.0.0/8"`},
+		{"telegram-startup-check: maybe", "Unknown `telegram-startup-check` \"maybe\""},
+		{"message-parse-mode: Markdown", "Unknown `message-parse-mode` \"Markdown\""},
+		{"message-date-timezone: Mars/Olympus", "Invalid `message-date-timezone`"},
+		{"telegram-bot-token: x\ntelegram-chat-ids: 42:general", "Invalid chat id \"42:general\""},
+		{"telegram-bot-token: x\nroutes: [{match: a@b, chat_ids: [\"42:0\"]}]", "Invalid chat id \"42:0\""},
+		{"telegram-bot-token: x\ntelegram-chat-ids: 42\nrules: [{chat_ids: [\":1\"]}]", "Invalid chat id \":1\""},
+		{"long-message-mode: chunks", "Unknown `long-message-mode` \"chunks\""},
+		{"forwarded-attachment-photo-quality: 0", "`forwarded-attachment-photo-quality` must be from 1 to 100"},
+		{"forwarded-attachment-photo-max-dimension: 8000", "`forwarded-attachment-photo-max-dimension` must be 0 or from 256 to 5000"},
+		{"message-template-engine: jinja", "Unknown `message-template-engine` \"jinja\""},
+		{"message-template-engine: go\nmessage-template: \"{{.Body\"", "Invalid message template"},
+		{"message-template-engine: go\nrules: [{template: \"{{if}}\"}]", "Invalid message template"},
+	}
+	for _, c := range cases {
+		_, _, err := loadTestConfig(t, c.config)
+		if assert.Error(t, err, c.config) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(template string) {
+		config := fmt.Sprintf(
+			"smtp-listen: %s:%d\n"+
+				"telegram-bot-token: \"42:ZZZ\"\n"+
+				"telegram-chat-ids: 42\n"+
+				"telegram-api-prefix: http://%s/\n"+
+				"telegram-rate-limit-per-chat: 0\n"+
+				"message-template: %s\n",
+			testSmtpListenHost, testSmtpListenPort, testHttpServerListen, template,
+		)
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+	}
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		writeConfig("A {body}")
+		smtpConfig, telegramConfig, err := LoadConfig(c)
+		assert.NoError(t, err)
+		d := startSmtp(smtpConfig, telegramConfig)
+		defer d.Shutdown()
+
+		err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+		assert.NoError(t, err)
+
+		writeConfig("B {body}")
+		assert.NoError(t, d.ReloadConfig(c))
+		err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+		assert.NoError(t, err)
+
+		// An invalid config is refused, the current one is kept.
+		writeConfig("[")
+		assert.Error(t, d.ReloadConfig(c))
+		err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+		assert.NoError(t, err)
+		return nil
+	}
+	assert.NoError(t, app.Run([]string{"smtp_to_telegram", "--config", path}))
+
+	assert.Equal(t, []string{"A hi", "B hi", "B hi"}, h.RequestMessages)
+}
+
+func TestReloadKeepsRateLimiter(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRateLimitPerChat = 1
+	d := startSmtp(makeSmtpConfig(), telegramConfig)
+	defer d.Shutdown()
+	rateLimiter := d.telegramConfig.Load().rateLimiter
+
+	newTelegramConfig := makeTelegramConfig()
+	newTelegramConfig.telegramRateLimitPerChat = 1
+	d.ReloadTelegramConfig(newTelegramConfig)
+	assert.Same(t, rateLimiter, d.telegramConfig.Load().rateLimiter)
+
+	newTelegramConfig = makeTelegramConfig()
+	newTelegramConfig.telegramRateLimitPerChat = 2
+	d.ReloadTelegramConfig(newTelegramConfig)
+	assert.NotSame(t, rateLimiter, d.telegramConfig.Load().rateLimiter)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TelegramHealthChecker periodically calls getMe, so that a revoked bot
+// token or an unreachable Telegram API shows up in the readiness probe
+// before the emails start to bounce.
+type TelegramHealthChecker struct {
+	telegramConfigStore *atomic.Pointer[TelegramConfig]
+	interval            time.Duration
+	// Unix nanoseconds of the last successful getMe, 0 if none.
+	lastSuccess atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewTelegramHealthChecker(
+	telegramConfigStore *atomic.Pointer[TelegramConfig],
+	interval time.Duration,
+) *TelegramHealthChecker {
+	return &TelegramHealthChecker{
+		telegramConfigStore: telegramConfigStore,
+		interval:            interval,
+		stop:                make(chan struct{}),
+		done:                make(chan struct{}),
+	}
+}
+
+func (c *TelegramHealthChecker) Start() {
+	go c.run()
+}
+
+func (c *TelegramHealthChecker) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+func (c *TelegramHealthChecker) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check()
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *TelegramHealthChecker) check() {
+	telegramConfig := c.telegramConfigStore.Load()
+	_, err := GetMe(telegramConfig, NewTelegramHttpClient(telegramConfig))
+	if err != nil {
+		logger.Warnf(
+			"Telegram health check failed: %s",
+			SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken),
+		)
+		return
+	}
+	c.lastSuccess.Store(time.Now().UnixNano())
+}
+
+// LastSuccess returns the time of the last successful getMe,
+// the zero time if there has been none.
+func (c *TelegramHealthChecker) LastSuccess() time.Time {
+	nanos := c.lastSuccess.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+const (
+	STARTUP_CHECK_FAIL = "fail"
+	STARTUP_CHECK_WARN = "warn"
+	STARTUP_CHECK_OFF  = "off"
+)
+
+// ConfiguredChatIds returns the deduplicated chat ids of the default
+// route, the routes and the rules, without the threads.
+func ConfiguredChatIds(telegramConfig *TelegramConfig) []string {
+	chatIds := []string{}
+	seen := map[string]bool{}
+	add := func(ids []string) {
+		for _, chatId := range ids {
+			chatId, _ = SplitChatThread(strings.TrimSpace(chatId))
+			if chatId != "" && !seen[chatId] {
+				seen[chatId] = true
+				chatIds = append(chatIds, chatId)
+			}
+		}
+	}
+	add(strings.Split(telegramConfig.telegramChatIds, ","))
+	for _, route := range telegramConfig.telegramRoutes {
+		add(route.chatIds)
+	}
+	for _, rule := range telegramConfig.telegramRules {
+		add(rule.chatIds)
+	}
+	return chatIds
+}
+
+// CheckTelegramConfig checks that the bot token is valid and that
+// the bot has access to all of the configured chats. The error lists
+// every invalid chat.
+func CheckTelegramConfig(telegramConfig *TelegramConfig) error {
+	client := NewTelegramHttpClient(telegramConfig)
+	sanitize := func(err error) string {
+		return SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken)
+	}
+	if _, err := GetMe(telegramConfig, client); err != nil {
+		return fmt.Errorf("Telegram startup check: getMe failed, is the bot token valid? %s", sanitize(err))
+	}
+	problems := []string{}
+	for _, chatId := range ConfiguredChatIds(telegramConfig) {
+		if _, err := GetChat(chatId, telegramConfig, client); err != nil {
+			problems = append(problems, fmt.Sprintf("chat %s is invalid: %s", chatId, sanitize(err)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Telegram startup check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func httpGet(t *testing.T, path string) (int, string) {
+	resp, err := http.Get("http://" + testHttpListen + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func makeHealthSmtpConfig() *SmtpConfig {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.httpListen = testHttpListen
+	smtpConfig.healthCheckInterval = 50 * time.Millisecond
+	smtpConfig.healthCheckMaxAge = 300 * time.Millisecond
+	return smtpConfig
+}
+
+func TestReadyz(t *testing.T) {
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	smtpConfig := makeHealthSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	code, _ := httpGet(t, "/healthz")
+	assert.Equal(t, 200, code)
+	waitFor(t, func() bool {
+		code, _ := httpGet(t, "/readyz")
+		return code == 200
+	})
+
+	// Telegram becomes unreachable.
+	s.Shutdown(context.Background())
+	waitFor(t, func() bool {
+		code, _ := httpGet(t, "/readyz")
+		return code == 503
+	})
+	_, body := httpGet(t, "/readyz")
+	assert.Contains(t, body, "the last successful getMe was")
+}
+
+func TestReadyzWithRevokedToken(t *testing.T) {
+	s := HttpServer(&ErrorHandler{})
+	defer s.Shutdown(context.Background())
+
+	smtpConfig := makeHealthSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	time.Sleep(2 * smtpConfig.healthCheckInterval)
+	code, body := httpGet(t, "/readyz")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "getMe has not succeeded yet\n", body)
+
+	code, _ = httpGet(t, "/healthz")
+	assert.Equal(t, 200, code)
+}
+
+func TestReadyzWithoutHealthChecks(t *testing.T) {
+	smtpConfig := makeHealthSmtpConfig()
+	smtpConfig.healthCheckInterval = 0
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	code, body := httpGet(t, "/readyz")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok\n", body)
+}
+
+func TestReadyzWithAccessList(t *testing.T) {
+	smtpConfig := makeHealthSmtpConfig()
+	smtpConfig.healthCheckInterval = 0
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("10.0.0.0/8", "")
+	telegramConfig := makeTelegramConfig()
+	// Not startSmtp, it waits for a successful connection.
+	d, err := SmtpStart(smtpConfig, telegramConfig)
+	require.NoError(t, err)
+	defer d.Shutdown()
+	denied := testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED))
+
+	code, body := httpGet(t, "/readyz")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok\n", body)
+	assert.Equal(t, denied, testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED)))
+}
+
+func TestProbeSmtp(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	assert.NoError(t, ProbeSmtp(smtpConfig.smtpListen, time.Second))
+	d.Shutdown()
+	assert.Error(t, ProbeSmtp(smtpConfig.smtpListen, time.Second))
+
+	// Accepts the connections, but never greets them.
+	l, err := net.Listen("tcp", smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Error(t, ProbeSmtp(smtpConfig.smtpListen, 100*time.Millisecond))
+}
+
+func TestConfiguredChatIds(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=142,-1001:7;@billing.local=-1002")
+	telegramConfig.telegramRules, _ = ParseTelegramRules(`[{"from":"^cron@","chat_ids":["-1001:8","-1003"]}]`)
+	assert.Equal(t, []string{"42", "142", "-1001", "-1002", "-1003"}, ConfiguredChatIds(telegramConfig))
+}
+
+func TestCheckTelegramConfig(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=-1001")
+
+	h := NewSuccessHandler()
+	s := HttpServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getChat") && r.FormValue("chat_id") != "42" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Shutdown(context.Background())
+
+	err := CheckTelegramConfig(telegramConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "chat 142 is invalid: Non-200 response from Telegram: (400)")
+		assert.Contains(t, err.Error(), "chat -1001 is invalid")
+		assert.Contains(t, err.Error(), "chat not found")
+		assert.NotContains(t, err.Error(), "chat 42 ")
+	}
+
+	telegramConfig.telegramChatIds = "42"
+	telegramConfig.telegramRoutes = nil
+	assert.NoError(t, CheckTelegramConfig(telegramConfig))
+}
+
+func TestCheckTelegramConfigSanitizesToken(t *testing.T) {
+	// Telegram is unreachable, the error contains the url.
+	telegramConfig := makeTelegramConfig()
+	err := CheckTelegramConfig(telegramConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "getMe failed")
+		assert.Contains(t, err.Error(), "bot***/getMe")
+		assert.NotContains(t, err.Error(), telegramConfig.telegramBotToken)
+	}
+}
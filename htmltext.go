@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HtmlToText renders the HTML body of an email as readable text:
+// the links become `text (url)`, the list items become bullets,
+// and the invisible elements such as style and script are skipped.
+func HtmlToText(s string) string {
+	return renderHtml(s, false)
+}
+
+// HtmlToTelegramHtml renders the HTML body of an email with only
+// the tags supported by Telegram, otherwise the same as HtmlToText:
+// https://core.telegram.org/bots/api#html-style
+func HtmlToTelegramHtml(s string) string {
+	return renderHtml(s, true)
+}
+
+func renderHtml(s string, telegram bool) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		// Never happens, the parser recovers from any input.
+		return s
+	}
+	r := &htmlRenderer{telegram: telegram}
+	r.render(doc)
+	lines := strings.Split(r.out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+var htmlSkippedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Object:   true,
+	atom.Iframe:   true,
+}
+
+// The number of the line breaks around the block elements.
+var htmlBlockElements = map[atom.Atom]int{
+	atom.P:          2,
+	atom.H1:         2,
+	atom.H2:         2,
+	atom.H3:         2,
+	atom.H4:         2,
+	atom.H5:         2,
+	atom.H6:         2,
+	atom.Ul:         2,
+	atom.Ol:         2,
+	atom.Dl:         2,
+	atom.Pre:        2,
+	atom.Blockquote: 2,
+	atom.Table:      2,
+	atom.Hr:         2,
+	atom.Div:        1,
+	atom.Section:    1,
+	atom.Article:    1,
+	atom.Header:     1,
+	atom.Footer:     1,
+	atom.Main:       1,
+	atom.Nav:        1,
+	atom.Aside:      1,
+	atom.Address:    1,
+	atom.Center:     1,
+	atom.Form:       1,
+	atom.Li:         1,
+	atom.Dt:         1,
+	atom.Dd:         1,
+	atom.Tr:         1,
+}
+
+// The Telegram tags of the inline elements.
+var htmlTelegramTags = map[atom.Atom]string{
+	atom.B:      "b",
+	atom.Strong: "b",
+	atom.H1:     "b",
+	atom.H2:     "b",
+	atom.H3:     "b",
+	atom.H4:     "b",
+	atom.H5:     "b",
+	atom.H6:     "b",
+	atom.Th:     "b",
+	atom.I:      "i",
+	atom.Em:     "i",
+	atom.Cite:   "i",
+	atom.U:      "u",
+	atom.Ins:    "u",
+	atom.S:      "s",
+	atom.Strike: "s",
+	atom.Del:    "s",
+	atom.Code:   "code",
+	atom.Kbd:    "code",
+	atom.Samp:   "code",
+	atom.Tt:     "code",
+}
+
+type htmlRenderer struct {
+	telegram bool
+	out      strings.Builder
+	// The line breaks to be written before the next text.
+	pendingBreaks int
+	// Whether a space is to be written before the next text.
+	pendingSpace bool
+	// The list markers of the enclosing lists, 0 for the bullets
+	// and the number of the next item for the ordered ones.
+	lists []int
+	pre   int
+	// Inside of the pre and code tags, which Telegram doesn't allow
+	// to contain other tags.
+	noTags int
+	// Inside of a link, the links can't be nested either.
+	inLink bool
+	// Right after the opening tag of a block.
+	blockStart bool
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	case html.DocumentNode:
+		r.renderChildren(n)
+		return
+	default:
+		return
+	}
+	if htmlSkippedElements[n.DataAtom] {
+		return
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		if r.pendingBreaks < 2 {
+			r.pendingBreaks++
+		}
+		r.pendingSpace = false
+		return
+	case atom.Img:
+		if alt := strings.TrimSpace(htmlAttr(n, "alt")); alt != "" {
+			r.text(alt)
+		}
+		return
+	case atom.A:
+		r.link(n)
+		return
+	case atom.Td, atom.Th:
+		r.pendingSpace = true
+	}
+
+	breaks := htmlBlockElements[n.DataAtom]
+	if (n.DataAtom == atom.Ul || n.DataAtom == atom.Ol) && len(r.lists) > 0 {
+		// A nested list continues the item.
+		breaks = 1
+	}
+	r.lineBreak(breaks)
+	switch n.DataAtom {
+	case atom.Ul:
+		r.lists = append(r.lists, 0)
+	case atom.Ol:
+		r.lists = append(r.lists, 1)
+	case atom.Li:
+		r.listItem()
+	case atom.Pre:
+		r.pre++
+	}
+	tag := htmlTelegramTags[n.DataAtom]
+	if n.DataAtom == atom.Pre {
+		tag = "pre"
+	} else if n.DataAtom == atom.Blockquote {
+		tag = "blockquote"
+	}
+	withTag := r.telegram && tag != "" && r.noTags == 0
+	verbatim := tag == "pre" || tag == "code"
+	if withTag {
+		r.openTag("<"+tag+">", breaks > 0)
+		if verbatim {
+			r.noTags++
+		}
+	}
+	r.renderChildren(n)
+	if withTag {
+		if verbatim {
+			r.noTags--
+		}
+		r.out.WriteString("</" + tag + ">")
+	}
+	switch n.DataAtom {
+	case atom.Ul, atom.Ol:
+		r.lists = r.lists[:len(r.lists)-1]
+	case atom.Pre:
+		r.pre--
+	}
+	r.lineBreak(breaks)
+	if n.DataAtom == atom.Td || n.DataAtom == atom.Th {
+		r.pendingSpace = true
+	}
+}
+
+func (r *htmlRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *htmlRenderer) link(n *html.Node) {
+	href := strings.TrimSpace(htmlAttr(n, "href"))
+	if !htmlLinkIsShown(href) || r.inLink {
+		r.renderChildren(n)
+		return
+	}
+	if r.telegram && r.noTags == 0 {
+		r.openTag(`<a href="`+htmlEscaper.Replace(strings.ReplaceAll(href, `"`, "%22"))+`">`, false)
+		start := r.out.Len()
+		r.inLink = true
+		r.renderChildren(n)
+		r.inLink = false
+		if r.out.Len() == start {
+			r.out.WriteString(htmlEscaper.Replace(href))
+		}
+		r.out.WriteString("</a>")
+		return
+	}
+	start := r.out.Len()
+	r.inLink = true
+	r.renderChildren(n)
+	r.inLink = false
+	text := strings.TrimSpace(r.out.String()[start:])
+	if r.telegram {
+		text = html.UnescapeString(text)
+	}
+	shownHref := strings.TrimPrefix(href, "mailto:")
+	if text == "" {
+		r.write(shownHref)
+	} else if text != shownHref && text != href {
+		r.pendingSpace = true
+		r.write("(" + shownHref + ")")
+	}
+}
+
+// htmlLinkIsShown tells whether the url of the link is worth showing,
+// unlike the anchors and the scripts.
+func htmlLinkIsShown(href string) bool {
+	lower := strings.ToLower(href)
+	for _, scheme := range []string{"http://", "https://", "mailto:", "tg://"} {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *htmlRenderer) listItem() {
+	indent := ""
+	marker := "•"
+	if len(r.lists) > 0 {
+		indent = strings.Repeat("  ", len(r.lists)-1)
+		if next := r.lists[len(r.lists)-1]; next > 0 {
+			marker = fmt.Sprintf("%d.", next)
+			r.lists[len(r.lists)-1]++
+		}
+	}
+	r.write(indent + marker)
+	r.pendingSpace = true
+}
+
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		r.write(s)
+		return
+	}
+	// Collapse the whitespace as a browser does.
+	if s != "" && strings.TrimLeft(s, " \t\r\n\f") != s {
+		r.pendingSpace = true
+	}
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		if i > 0 {
+			r.pendingSpace = true
+		}
+		r.write(field)
+	}
+	if len(fields) > 0 && strings.TrimRight(s, " \t\r\n\f") != s {
+		r.pendingSpace = true
+	}
+}
+
+// write writes the text after the pending line breaks or space.
+func (r *htmlRenderer) write(s string) {
+	atLineStart := r.flush()
+	if r.pendingSpace && !atLineStart {
+		r.out.WriteString(" ")
+	}
+	r.pendingSpace = false
+	if r.telegram {
+		s = htmlEscaper.Replace(s)
+	}
+	r.out.WriteString(s)
+}
+
+// openTag writes the Telegram tag after the pending line breaks or space.
+// The line breaks right after the tag of a block are skipped.
+func (r *htmlRenderer) openTag(tag string, block bool) {
+	atLineStart := r.flush()
+	if r.pendingSpace && !atLineStart {
+		r.out.WriteString(" ")
+	}
+	r.pendingSpace = false
+	r.out.WriteString(tag)
+	r.blockStart = block
+}
+
+// flush writes the pending line breaks, unless nothing has been
+// written yet, and tells whether the output is at the line start.
+func (r *htmlRenderer) flush() bool {
+	if r.out.Len() == 0 || r.blockStart {
+		r.pendingBreaks = 0
+		r.blockStart = false
+		return true
+	}
+	if r.pendingBreaks > 0 {
+		r.out.WriteString(strings.Repeat("\n", r.pendingBreaks))
+		r.pendingBreaks = 0
+		r.pendingSpace = false
+		return true
+	}
+	return strings.HasSuffix(r.out.String(), "\n")
+}
+
+func (r *htmlRenderer) lineBreak(n int) {
+	if r.pre > 0 {
+		// The text of pre has its own line breaks.
+		return
+	}
+	if n > r.pendingBreaks {
+		r.pendingBreaks = n
+	}
+	if n > 0 {
+		r.pendingSpace = false
+	}
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
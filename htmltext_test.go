@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testHtmlEmail = `<html>
+<head><title>Alert</title><style>p { color: red; }</style></head>
+<body>
+<script>alert("x")</script>
+<h1>Disk   is <i>full</i></h1>
+<p>Host <b>web-1</b> &amp; <a href="https://grafana.local/d/1?a=1&amp;b=2">the dashboard</a>,
+see <a href="https://example.com">https://example.com</a> or <a href="#top">top</a>.</p>
+<ul><li>one</li><li>two<ol><li>nested</li><li>list</li></ol></li></ul>
+<table><tr><th>Used</th><td>95%</td></tr></table>
+<pre>df -h
+/  95%</pre>
+line<br>break
+</body>
+</html>`
+
+func TestHtmlToText(t *testing.T) {
+	exp := "Disk is full\n" +
+		"\n" +
+		"Host web-1 & the dashboard (https://grafana.local/d/1?a=1&b=2), " +
+		"see https://example.com or top.\n" +
+		"\n" +
+		"• one\n" +
+		"• two\n" +
+		"  1. nested\n" +
+		"  2. list\n" +
+		"\n" +
+		"Used 95%\n" +
+		"\n" +
+		"df -h\n" +
+		"/  95%\n" +
+		"\n" +
+		"line\n" +
+		"break"
+	assert.Equal(t, exp, HtmlToText(testHtmlEmail))
+}
+
+func TestHtmlToTelegramHtml(t *testing.T) {
+	exp := "<b>Disk is <i>full</i></b>\n" +
+		"\n" +
+		`Host <b>web-1</b> &amp; <a href="https://grafana.local/d/1?a=1&amp;b=2">the dashboard</a>, ` +
+		`see <a href="https://example.com">https://example.com</a> or top.` + "\n" +
+		"\n" +
+		"• one\n" +
+		"• two\n" +
+		"  1. nested\n" +
+		"  2. list\n" +
+		"\n" +
+		"<b>Used</b> 95%\n" +
+		"\n" +
+		"<pre>df -h\n" +
+		"/  95%</pre>\n" +
+		"\n" +
+		"line\n" +
+		"break"
+	assert.Equal(t, exp, HtmlToTelegramHtml(testHtmlEmail))
+
+	assert.Equal(t, "<pre>a &lt;b&gt;</pre>", HtmlToTelegramHtml("<pre>a <b>&lt;b&gt;</b></pre>"))
+	assert.Equal(t, "<blockquote>quote</blockquote>", HtmlToTelegramHtml("<blockquote><p>quote</p></blockquote>"))
+}
+
+func TestHtmlOnlyEmail(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "{subject}\\n\\n{body}"
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	msg := "Subject: <Alert>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		`<p>Host <b>web-1</b> is <a href="https://grafana.local/">down</a></p><ul><li>a &lt; b</li></ul>`
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(msg))
+	require.NoError(t, err)
+
+	telegramConfig.messageParseMode = PARSE_MODE_HTML
+	d.ReloadTelegramConfig(telegramConfig)
+	err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(msg))
+	require.NoError(t, err)
+
+	require.Len(t, h.RequestMessages, 4)
+	assert.Equal(t,
+		"<Alert>\n\nHost web-1 is down (https://grafana.local/)\n\n• a < b",
+		h.RequestMessages[0])
+	assert.Equal(t,
+		"&lt;Alert&gt;\n\nHost <b>web-1</b> is <a href=\"https://grafana.local/\">down</a>\n\n• a &lt; b",
+		h.RequestMessages[2])
+}
+
+func TestHtmlOnlyEmailGoTemplate(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplateEngine = TEMPLATE_ENGINE_GO
+	telegramConfig.messageParseMode = PARSE_MODE_HTML
+	telegramConfig.messageTemplate = "{{or .BodyHtml (.Body | escape)}}"
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	msg := "Subject: Alert\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		`<p>Host <b>web-1</b> is down, a &lt; b</p>`
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(msg))
+	require.NoError(t, err)
+	err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"},
+		[]byte("Subject: Alert\r\n\r\nHost web-1 is down, a < b"))
+	require.NoError(t, err)
+
+	require.Len(t, h.RequestMessages, 4)
+	assert.Equal(t, "Host <b>web-1</b> is down, a &lt; b", h.RequestMessages[0])
+	assert.Equal(t, "Host web-1 is down, a &lt; b", h.RequestMessages[2])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// StartHttp starts the HTTP server of the monitoring endpoints.
+func (s *Server) StartHttp() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", s.serveReadyz)
+
+	l, err := net.Listen("tcp", s.smtpConfig.httpListen)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %s: %s", s.smtpConfig.httpListen, err)
+	}
+	s.http = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.http.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("HTTP server error: %s", err)
+		}
+	}()
+	logger.Infof("Listening on HTTP %s", l.Addr())
+	return nil
+}
+
+// The time the SMTP listener has to greet the readiness probe.
+const smtpProbeTimeout = 2 * time.Second
+
+// serveReadyz responds with 200 when the SMTP listener greets
+// a connection and the Telegram API has been reachable recently,
+// 503 otherwise.
+//
+// With the front, guerrilla behind it is probed instead, so that
+// the probes aren't subject to the access list and aren't counted
+// as the rejected commands.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	problems := []string{}
+	address := s.smtpConfig.smtpListen
+	if s.front != nil {
+		address = s.front.backendAddr
+	}
+	if !s.ready.Load() || (s.front != nil && !s.front.Serving()) {
+		problems = append(problems, "the SMTP listener is down")
+	} else if err := ProbeSmtp(address, smtpProbeTimeout); err != nil {
+		problems = append(problems, fmt.Sprintf("the SMTP listener is down: %s", err))
+	}
+	if s.healthChecker != nil {
+		lastSuccess := s.healthChecker.LastSuccess()
+		if lastSuccess.IsZero() {
+			problems = append(problems, "getMe has not succeeded yet")
+		} else if since := time.Since(lastSuccess); since > s.smtpConfig.healthCheckMaxAge {
+			problems = append(problems, fmt.Sprintf(
+				"the last successful getMe was %s ago", since.Round(time.Second)))
+		}
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(problems, "\n") + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ProbeSmtp connects to the SMTP server and waits for its greeting.
+func ProbeSmtp(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "220") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(greeting))
+	}
+	conn.Write([]byte("QUIT\r\n"))
+	return nil
+}
+
+func (s *Server) shutdownHttp() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.http.Shutdown(ctx)
+}
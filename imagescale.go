@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"path/filepath"
+	"strings"
+)
+
+// The images with more pixels aren't decoded, it would take
+// too much memory: 4 bytes per pixel, twice.
+const DOWNSCALE_MAX_PIXELS = 25 * 1000 * 1000
+
+// The dimensions of the photos accepted by Telegram:
+// https://core.telegram.org/bots/api#sendphoto
+const (
+	TELEGRAM_PHOTO_MAX_DIMENSIONS_SUM = 10000
+	TELEGRAM_PHOTO_MAX_RATIO          = 20
+)
+
+// The smallest dimension tried to fit a photo in the size limit.
+const DOWNSCALE_MIN_DIMENSION = 256
+
+// DownscalePhoto re-encodes the JPEG or PNG photo as a JPEG of at most
+// `maxDimension` pixels in width and height and at most `maxSize` bytes,
+// reducing the dimensions further if needed. Returns nil if the photo
+// needs no downscaling or can't be downscaled.
+func DownscalePhoto(content []byte, maxDimension int, quality int, maxSize int) []byte {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || config.Width*config.Height > DOWNSCALE_MAX_PIXELS {
+		return nil
+	}
+	if len(content) <= maxSize && config.Width <= maxDimension && config.Height <= maxDimension {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	// The re-encoded photo has no EXIF, so its pixels are rotated instead.
+	src := orientImage(flattenImage(img), JpegOrientation(content))
+	for dimension := maxDimension; dimension >= DOWNSCALE_MIN_DIMENSION; dimension = dimension * 3 / 4 {
+		buf := new(bytes.Buffer)
+		err := jpeg.Encode(buf, downscaleImage(src, dimension), &jpeg.Options{Quality: quality})
+		if err != nil {
+			return nil
+		}
+		if buf.Len() <= maxSize {
+			return buf.Bytes()
+		}
+	}
+	return nil
+}
+
+// FitsTelegramPhotoDimensions tells whether Telegram accepts the
+// dimensions of the photo, also when they are unknown.
+func FitsTelegramPhotoDimensions(content []byte) bool {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return true
+	}
+	return config.Width+config.Height <= TELEGRAM_PHOTO_MAX_DIMENSIONS_SUM &&
+		config.Width <= config.Height*TELEGRAM_PHOTO_MAX_RATIO &&
+		config.Height <= config.Width*TELEGRAM_PHOTO_MAX_RATIO
+}
+
+// flattenImage draws the image on white, so that the transparent
+// pixels become white.
+func flattenImage(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// JpegOrientation returns the EXIF orientation of the JPEG, from 1 to 8,
+// 1 (as is) when it's missing or isn't a JPEG.
+// https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+func JpegOrientation(content []byte) int {
+	if !bytes.HasPrefix(content, []byte{0xff, 0xd8}) {
+		return 1
+	}
+	for i := 2; i+4 <= len(content) && content[i] == 0xff; {
+		marker := content[i+1]
+		length := int(binary.BigEndian.Uint16(content[i+2:]))
+		if marker == 0xda || length < 2 || i+2+length > len(content) {
+			// The image data starts, no EXIF before it.
+			break
+		}
+		segment := content[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation returns the Orientation tag of the first IFD
+// of the TIFF structure of EXIF.
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if len(tiff) < 8 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// A SHORT value is in the first half of the value field.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// orientImage flips and rotates the image the way EXIF orientation
+// tells to display it.
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	// The source pixel of the displayed one.
+	at := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return srcWidth - 1 - x, y },
+		3: func(x, y int) (int, int) { return srcWidth - 1 - x, srcHeight - 1 - y },
+		4: func(x, y int) (int, int) { return x, srcHeight - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, srcHeight - 1 - x },
+		7: func(x, y int) (int, int) { return srcWidth - 1 - y, srcHeight - 1 - x },
+		8: func(x, y int) (int, int) { return srcWidth - 1 - y, x },
+	}[orientation]
+	width, height := srcWidth, srcHeight
+	if orientation >= 5 {
+		// Rotated by 90 degrees.
+		width, height = srcHeight, srcWidth
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := at(x, y)
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
+
+// downscaleImage fits the image in a square of `dimension` pixels
+// by averaging the pixels.
+func downscaleImage(src *image.RGBA, dimension int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > dimension || height > dimension {
+		if width >= height {
+			width, height = dimension, max(1, height*dimension/width)
+		} else {
+			width, height = max(1, width*dimension/height), dimension
+		}
+	}
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*bounds.Dy()/height, max((y+1)*bounds.Dy()/height, y*bounds.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*bounds.Dx()/width, max((x+1)*bounds.Dx()/width, x*bounds.Dx()/width+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[offset+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// DownscaledPhotoFilename returns the filename of the photo
+// re-encoded as a JPEG.
+func DownscaledPhotoFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return filename
+	}
+	return strings.TrimSuffix(filename, ext) + ".jpg"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func makeTestPng(t *testing.T, width int, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+			}
+			// The right half is transparent.
+		}
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, img))
+	return buf.Bytes()
+}
+
+func TestDownscalePhoto(t *testing.T) {
+	content := makeTestPng(t, 1000, 500)
+
+	assert.Nil(t, DownscalePhoto(content, 1000, 85, len(content)))
+	assert.Nil(t, DownscalePhoto([]byte("not an image"), 100, 85, 1024*1024))
+
+	photo := DownscalePhoto(content, 400, 85, 1024*1024)
+	require.NotNil(t, photo)
+	img, err := jpeg.Decode(bytes.NewReader(photo))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 400, 200), img.Bounds())
+	r, g, b, _ := img.At(390, 100).RGBA()
+	assert.Greater(t, r>>8, uint32(250), "transparent becomes white")
+	assert.Greater(t, g>>8, uint32(250))
+	assert.Greater(t, b>>8, uint32(250))
+
+	// The dimensions are reduced until the photo fits.
+	large := DownscalePhoto(content, 800, 85, 1024*1024)
+	require.NotNil(t, large)
+	small := DownscalePhoto(content, 800, 85, len(large)-1)
+	require.NotNil(t, small)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(small))
+	require.NoError(t, err)
+	assert.Less(t, config.Width, 800)
+}
+
+// makeTestJpeg returns a JPEG with the red left half and the blue right
+// half, and with the EXIF orientation if it's not 0.
+func makeTestJpeg(t *testing.T, width int, height int, orientation int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, img, nil))
+	content := buf.Bytes()
+	if orientation == 0 {
+		return content
+	}
+	// A big-endian TIFF with the only IFD of the Orientation tag.
+	exif := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string(rune(orientation)) + "\x00\x00" +
+		"\x00\x00\x00\x00")
+	segment := []byte{0xff, 0xe1, 0, byte(len(exif) + 2)}
+	return append(append(append([]byte{0xff, 0xd8}, segment...), exif...), content[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	assert.Equal(t, 1, JpegOrientation(makeTestJpeg(t, 10, 10, 0)))
+	assert.Equal(t, 6, JpegOrientation(makeTestJpeg(t, 10, 10, 6)))
+	assert.Equal(t, 1, JpegOrientation(makeTestPng(t, 10, 10)))
+	assert.Equal(t, 1, JpegOrientation([]byte{0xff, 0xd8, 0xff, 0xe1, 0xff}))
+}
+
+func TestDownscalePhotoOriented(t *testing.T) {
+	content := makeTestJpeg(t, 600, 300, 6)
+	photo := DownscalePhoto(content, 400, 85, 1024*1024)
+	require.NotNil(t, photo)
+	img, err := jpeg.Decode(bytes.NewReader(photo))
+	require.NoError(t, err)
+	// Rotated clockwise: the left half is on top.
+	assert.Equal(t, image.Rect(0, 0, 200, 400), img.Bounds())
+	r, _, b, _ := img.At(100, 50).RGBA()
+	assert.Greater(t, r>>8, uint32(200))
+	assert.Less(t, b>>8, uint32(50))
+	r, _, b, _ = img.At(100, 350).RGBA()
+	assert.Less(t, r>>8, uint32(50))
+	assert.Greater(t, b>>8, uint32(200))
+}
+
+func TestFitsTelegramPhotoDimensions(t *testing.T) {
+	assert.True(t, FitsTelegramPhotoDimensions(makeTestPng(t, 100, 50)))
+	assert.True(t, FitsTelegramPhotoDimensions([]byte("JPG")))
+	assert.False(t, FitsTelegramPhotoDimensions(makeTestPng(t, 2100, 100)))
+	assert.False(t, FitsTelegramPhotoDimensions(makeTestPng(t, 5, 101)))
+}
+
+func TestPhotoDownscaled(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = "42"
+	telegramConfig.forwardedAttachmentMaxSize = 1024 * 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024 * 1024
+	telegramConfig.forwardedAttachmentPhotoMaxDimension = 300
+	telegramConfig.forwardedAttachmentPhotoQuality = 80
+	telegramConfig.forwardedAttachmentPhotoSendOriginal = true
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	content := makeTestPng(t, 1000, 500)
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Snapshot")
+	m.SetBody("text/plain", "Camera 1")
+	m.Attach("snapshot.png", goMailBody(content))
+	m.Attach("small.png", goMailBody(makeTestPng(t, 10, 10)))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 1)
+	assert.Contains(t, h.RequestMessages[0], "snapshot.png (image/png) ")
+	assert.Contains(t, h.RequestMessages[0], "downscaled, sending...")
+	require.Len(t, h.RequestDocuments, 3)
+	// The photos go as a media group, the original as a document.
+	photo := h.RequestDocuments[0]
+	assert.Equal(t, "snapshot.jpg", photo.filename)
+	assert.Equal(t, "snapshot.png", photo.caption)
+	assert.Equal(t, ATTACHMENT_TYPE_PHOTO, photo.fileType)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(photo.content))
+	require.NoError(t, err)
+	assert.Equal(t, 300, config.Width)
+	assert.Equal(t, 150, config.Height)
+	assert.Equal(t, "small.png", h.RequestDocuments[1].filename)
+	assert.Equal(t, &FormattedAttachment{
+		filename: "snapshot.png",
+		caption:  "snapshot.png",
+		content:  content,
+		fileType: ATTACHMENT_TYPE_DOCUMENT,
+	}, h.RequestDocuments[2])
+}
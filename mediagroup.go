@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"slices"
+)
+
+// The maximum number of the items of a media group.
+const MEDIA_GROUP_MAX_SIZE = 10
+
+type TelegramAPIMessagesResult struct {
+	Ok     bool                  `json:"ok"`
+	Result []*TelegramAPIMessage `json:"result"`
+}
+
+type TelegramAPIInputMedia struct {
+	// https://core.telegram.org/bots/api#inputmedia
+	Type    string `json:"type"`
+	Media   string `json:"media"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// SentAttachments is the state of the attachments of an email
+// shared by its chats, so that the next chats get them the same way.
+type SentAttachments struct {
+	// The `file_id`s of the attachments already sent to another chat.
+	fileIds map[*FormattedAttachment]string
+	// The media refused by Telegram, which are sent as documents.
+	documents map[*FormattedAttachment]bool
+}
+
+func NewSentAttachments() *SentAttachments {
+	return &SentAttachments{
+		fileIds:   map[*FormattedAttachment]string{},
+		documents: map[*FormattedAttachment]bool{},
+	}
+}
+
+// FileType returns the type the attachment is sent as.
+func (s *SentAttachments) FileType(attachment *FormattedAttachment) int {
+	if s.documents[attachment] {
+		return ATTACHMENT_TYPE_DOCUMENT
+	}
+	return attachment.fileType
+}
+
+// GroupAttachments groups the attachments which can be sent together
+// by up to MEDIA_GROUP_MAX_SIZE, since Telegram allows to mix only
+// the photos and the videos in a media group. The animations and
+// the voices are never grouped and go first, then the groups of
+// the kind which comes first.
+func GroupAttachments(attachments []*FormattedAttachment) [][]*FormattedAttachment {
+	byKind := map[string][]*FormattedAttachment{}
+	kinds := []string{}
+	groups := [][]*FormattedAttachment{}
+	for _, attachment := range attachments {
+		kind := attachmentTypeMethods[attachment.fileType].mediaGroupKind
+		if kind == "" {
+			groups = append(groups, []*FormattedAttachment{attachment})
+			continue
+		}
+		if _, ok := byKind[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+		byKind[kind] = append(byKind[kind], attachment)
+	}
+	for _, kind := range kinds {
+		kindAttachments := byKind[kind]
+		for len(kindAttachments) > MEDIA_GROUP_MAX_SIZE {
+			groups = append(groups, kindAttachments[:MEDIA_GROUP_MAX_SIZE])
+			kindAttachments = kindAttachments[MEDIA_GROUP_MAX_SIZE:]
+		}
+		groups = append(groups, kindAttachments)
+	}
+	return groups
+}
+
+// SendAttachmentGroupToChat sends the attachments as a media group
+// replying to the message, or one by one if there is only one of them
+// or the media group is refused. `sent` is updated with the `file_id`s
+// of the uploaded attachments.
+func SendAttachmentGroupToChat(
+	group []*FormattedAttachment,
+	chatId string,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+	protectContent bool,
+	sent *SentAttachments,
+) error {
+	// Sent one by one once some of the media have been refused
+	// for another chat, the documents don't mix with them.
+	if len(group) > 1 && !slices.ContainsFunc(group, func(a *FormattedAttachment) bool {
+		return sent.documents[a]
+	}) {
+		err := SendMediaGroupToChat(
+			group, chatId, telegramConfig, client, sentMessage, protectContent, sent)
+		if err == nil {
+			return nil
+		}
+		logger.Infof("Unable to send the attachments as a media group, sending them one by one: %s",
+			SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+	}
+	var firstErr error
+	for _, attachment := range group {
+		err := SendAttachmentToChat(attachment, chatId, telegramConfig, client, sentMessage, protectContent, sent)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func SendMediaGroupToChat(
+	group []*FormattedAttachment,
+	chatId string,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+	protectContent bool,
+	sent *SentAttachments,
+) error {
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	// https://core.telegram.org/bots/api#sendmediagroup
+	WriteChatIdFields(w, chatId)
+	panicIfError(w.WriteField("reply_to_message_id", fmt.Sprintf("%s", sentMessage.MessageId)))
+	panicIfError(w.WriteField("disable_notification", "true"))
+	panicIfError(w.WriteField("protect_content", fmt.Sprintf("%t", protectContent)))
+	media := []TelegramAPIInputMedia{}
+	for i, attachment := range group {
+		item := TelegramAPIInputMedia{
+			Type:    attachmentTypeMethods[attachment.fileType].field,
+			Media:   sent.fileIds[attachment],
+			Caption: attachment.caption,
+		}
+		if item.Media == "" {
+			name := fmt.Sprintf("file%d", i)
+			item.Media = "attach://" + name
+			dw, err := w.CreateFormFile(name, attachment.filename)
+			panicIfError(err)
+			_, err = dw.Write(attachment.content)
+			panicIfError(err)
+		}
+		media = append(media, item)
+	}
+	mediaJson, err := json.Marshal(media)
+	panicIfError(err)
+	panicIfError(w.WriteField("media", string(mediaJson)))
+	w.Close()
+
+	j, err := CallTelegramApi(
+		"sendMediaGroup",
+		chatId,
+		w.FormDataContentType(),
+		buf.Bytes(),
+		telegramConfig,
+		client,
+	)
+	if err != nil {
+		return err
+	}
+	attachments.WithLabelValues("sent").Add(float64(len(group)))
+	result := &TelegramAPIMessagesResult{}
+	if err := json.Unmarshal(j, result); err != nil || len(result.Result) != len(group) {
+		// Sent anyway, just unable to reuse the files.
+		return nil
+	}
+	for i, attachment := range group {
+		sent.fileIds[attachment] = SentFileId(result.Result[i], sent.fileIds[attachment])
+	}
+	return nil
+}
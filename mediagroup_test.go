@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func sendSnapshotsEmail(t *testing.T, photos int) {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Motion detected")
+	m.SetBody("text/plain", "Camera 1")
+	m.Attach("report.txt", goMailBody([]byte("TXT")))
+	for i := 1; i <= photos; i++ {
+		m.Attach(fmt.Sprintf("snapshot%d.jpg", i), goMailBody([]byte(fmt.Sprintf("JPG%d", i))))
+	}
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+}
+
+func TestGroupAttachments(t *testing.T) {
+	photo1 := &FormattedAttachment{filename: "1.jpg", fileType: ATTACHMENT_TYPE_PHOTO}
+	photo2 := &FormattedAttachment{filename: "2.jpg", fileType: ATTACHMENT_TYPE_PHOTO}
+	document := &FormattedAttachment{filename: "1.txt", fileType: ATTACHMENT_TYPE_DOCUMENT}
+	assert.Equal(t,
+		[][]*FormattedAttachment{{photo1, photo2}, {document}},
+		GroupAttachments([]*FormattedAttachment{photo1, document, photo2}))
+
+	video := &FormattedAttachment{filename: "1.mp4", fileType: ATTACHMENT_TYPE_VIDEO}
+	voice := &FormattedAttachment{filename: "1.ogg", fileType: ATTACHMENT_TYPE_VOICE}
+	assert.Equal(t,
+		[][]*FormattedAttachment{{voice}, {photo1, video}},
+		GroupAttachments([]*FormattedAttachment{photo1, voice, video}))
+
+	many := []*FormattedAttachment{}
+	for i := 0; i < 23; i++ {
+		many = append(many, photo1)
+	}
+	groups := GroupAttachments(many)
+	require.Len(t, groups, 3)
+	assert.Len(t, groups[0], 10)
+	assert.Len(t, groups[1], 10)
+	assert.Len(t, groups[2], 3)
+}
+
+func TestAttachmentsMediaGroup(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	sendSnapshotsEmail(t, 12)
+
+	require.Len(t, h.RequestMessages, 2)
+	// The single document is sent on its own.
+	assert.Equal(t, []int{10, 2, 10, 2}, h.RequestMediaGroups)
+	require.Len(t, h.RequestDocuments, 2*13)
+	assert.Equal(t, "report.txt", h.RequestDocuments[0].filename)
+	assert.Equal(t, "snapshot1.jpg", h.RequestDocuments[1].filename)
+	assert.Equal(t, "snapshot1.jpg", h.RequestDocuments[1].caption)
+	assert.Equal(t, []byte("JPG12"), h.RequestDocuments[12].content)
+	// The second chat gets the files uploaded to the first one.
+	for i := 0; i < 13; i++ {
+		assert.Equal(t, "", h.RequestFileIds[i])
+		assert.NotEqual(t, "", h.RequestFileIds[13+i])
+		assert.Equal(t, h.RequestDocuments[i], h.RequestDocuments[13+i])
+	}
+}
+
+func TestAttachmentsMediaGroupFallback(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024
+	telegramConfig.forwardedAttachmentRespectErrors = true
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	h.FailMediaGroups = true
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	sendSnapshotsEmail(t, 3)
+
+	require.Len(t, h.RequestMessages, 2)
+	assert.Len(t, h.RequestMediaGroups, 0)
+	require.Len(t, h.RequestDocuments, 2*4)
+	assert.Equal(t, "snapshot3.jpg", h.RequestDocuments[3].filename)
+	assert.Equal(t, []string{"", "", "", ""}, h.RequestFileIds[:4])
+}
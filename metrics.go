@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "smtp_to_telegram"
+
+// The reasons of the rejected connections and commands.
+const (
+	REJECT_REASON_ACCESS_DENIED         = "access_denied"
+	REJECT_REASON_TLS_REQUIRED          = "tls_required"
+	REJECT_REASON_AUTH_REQUIRED         = "auth_required"
+	REJECT_REASON_AUTH_FAILED           = "auth_failed"
+	REJECT_REASON_RELAY_DENIED          = "relay_denied"
+	REJECT_REASON_RECIPIENT_NOT_ALLOWED = "recipient_not_allowed"
+	REJECT_REASON_NO_ROUTE              = "no_route"
+)
+
+// The reasons of the rejected mails.
+const (
+	REJECT_REASON_REJECTED       = "rejected"
+	REJECT_REASON_FORMAT_ERROR   = "format_error"
+	REJECT_REASON_TELEGRAM_ERROR = "telegram_error"
+	REJECT_REASON_SPOOL_ERROR    = "spool_error"
+)
+
+var (
+	mailsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mails_received_total",
+		Help:      "Mails received after DATA.",
+	})
+	mailsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mails_accepted_total",
+		Help:      "Mails accepted for delivery (including the spooled and the dropped by rules).",
+	})
+	mailsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mails_rejected_total",
+		Help:      "Mails rejected after DATA, by reason.",
+	}, []string{"reason"})
+	commandsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "smtp_commands_rejected_total",
+		Help:      "Connections and SMTP commands before DATA rejected by the server, by reason.",
+	}, []string{"reason"})
+	formatEmailDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "format_email_duration_seconds",
+		Help:      "Time spent parsing and formatting the mails.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	spoolDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spool_delivery_attempts_total",
+		Help:      "Delivery attempts of the spooled mails by result: delivered, retrying, rejected or expired.",
+	}, []string{"result"})
+	envelopeSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "envelope_size_bytes",
+		Help:      "Size of the received mails.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1k .. 256m
+	})
+	telegramApiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "telegram_api_requests_total",
+		Help:      "Telegram API requests by method and HTTP status, `error` when no response has been received.",
+	}, []string{"method", "status"})
+	telegramApiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "telegram_api_request_duration_seconds",
+		Help:      "Latency of the Telegram API requests by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	attachments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "attachments_total",
+		Help:      "Attachments per chat by result: sent, discarded (not forwarded due to the limits) or failed.",
+	}, []string{"result"})
+)
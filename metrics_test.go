@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+var testHttpListen = "127.0.0.1:22781"
+
+func TestMetrics(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.httpListen = testHttpListen
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	received := testutil.ToFloat64(mailsReceived)
+	accepted := testutil.ToFloat64(mailsAccepted)
+	sendMessageOk := testutil.ToFloat64(telegramApiRequests.WithLabelValues("sendMessage", "200"))
+	attachmentsSent := testutil.ToFloat64(attachments.WithLabelValues("sent"))
+	attachmentsDiscarded := testutil.ToFloat64(attachments.WithLabelValues("discarded"))
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetBody("text/plain", "hi")
+	m.Attach("small.txt", goMailBody([]byte("small")))
+	m.Attach("large.txt", goMailBody(make([]byte, 2048)))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	assert.Equal(t, received+1, testutil.ToFloat64(mailsReceived))
+	assert.Equal(t, accepted+1, testutil.ToFloat64(mailsAccepted))
+	assert.Equal(t, sendMessageOk+2, testutil.ToFloat64(telegramApiRequests.WithLabelValues("sendMessage", "200")))
+	assert.Equal(t, attachmentsSent+2, testutil.ToFloat64(attachments.WithLabelValues("sent")))
+	assert.Equal(t, attachmentsDiscarded+2, testutil.ToFloat64(attachments.WithLabelValues("discarded")))
+
+	resp, err := http.Get("http://" + testHttpListen + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), `smtp_to_telegram_telegram_api_requests_total{method="sendMessage",status="200"}`)
+	assert.Contains(t, string(body), `smtp_to_telegram_telegram_api_request_duration_seconds_bucket{method="sendDocument",le="+Inf"}`)
+	assert.Contains(t, string(body), `smtp_to_telegram_envelope_size_bytes_count`)
+	assert.Contains(t, string(body), `smtp_to_telegram_format_email_duration_seconds_count`)
+}
+
+func TestMetricsRejectedByReason(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	s := HttpServer(&ErrorHandler{})
+	defer s.Shutdown(context.Background())
+
+	rejected := testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_TELEGRAM_ERROR))
+	failed := testutil.ToFloat64(telegramApiRequests.WithLabelValues("sendMessage", "400"))
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Error(t, err)
+
+	assert.Equal(t, rejected+1, testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_TELEGRAM_ERROR)))
+	assert.Equal(t, failed+1, testutil.ToFloat64(telegramApiRequests.WithLabelValues("sendMessage", "400")))
+}
+
+func TestMetricsFormatError(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplateEngine = TEMPLATE_ENGINE_GO
+	telegramConfig.messageTemplate = `{{.Subject | replace "(" ""}}`
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	formatErrors := testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_FORMAT_ERROR))
+	telegramErrors := testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_TELEGRAM_ERROR))
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Error(t, err)
+
+	assert.Equal(t, formatErrors+1, testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_FORMAT_ERROR)))
+	assert.Equal(t, telegramErrors, testutil.ToFloat64(mailsRejected.WithLabelValues(REJECT_REASON_TELEGRAM_ERROR)))
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestMetricsCommandsRejected(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAcceptedRecipients, _ = ParseAcceptedRecipients("alerts.local")
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	relayDenied := testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_RELAY_DENIED))
+	received := testutil.ToFloat64(mailsReceived)
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.Error(t, err)
+
+	assert.Equal(t, relayDenied+1, testutil.ToFloat64(commandsRejected.WithLabelValues(REJECT_REASON_RELAY_DENIED)))
+	assert.Equal(t, received, testutil.ToFloat64(mailsReceived))
+}
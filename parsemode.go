@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The formatting options of the Telegram messages:
+// https://core.telegram.org/bots/api#formatting-options
+const (
+	PARSE_MODE_NONE        = ""
+	PARSE_MODE_HTML        = "HTML"
+	PARSE_MODE_MARKDOWN_V2 = "MarkdownV2"
+)
+
+// The maximum length of the text of a message.
+const TELEGRAM_MESSAGE_MAX_LENGTH = 4096
+
+// TextLength returns the length of the text the way Telegram counts it,
+// in UTF-16 code units.
+func TextLength(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+var (
+	htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	// All of the characters which must be escaped outside of
+	// the entities, and the backslash itself.
+	markdownV2Escaper = strings.NewReplacer(
+		"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]",
+		"(", "\\(", ")", "\\)", "~", "\\~", "`", "\\`", ">", "\\>",
+		"#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|",
+		"{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+	)
+)
+
+func ValidateParseMode(parseMode string) error {
+	switch parseMode {
+	case PARSE_MODE_NONE, PARSE_MODE_HTML, PARSE_MODE_MARKDOWN_V2:
+		return nil
+	}
+	return fmt.Errorf("Unknown `message-parse-mode` %q", parseMode)
+}
+
+// EscapeForParseMode escapes the text so that it is displayed
+// literally in a message with the parse mode.
+func EscapeForParseMode(s string, parseMode string) string {
+	switch parseMode {
+	case PARSE_MODE_HTML:
+		return htmlEscaper.Replace(s)
+	case PARSE_MODE_MARKDOWN_V2:
+		return markdownV2Escaper.Replace(s)
+	}
+	return s
+}
+
+// TruncateFormatted cuts the formatted text to at most `limit` characters
+// as counted by TextLength.
+// The cut is never made inside of a tag, an entity or an escape
+// sequence, and the formatting left open is closed within the limit.
+// A link which doesn't fit in MarkdownV2 is dropped entirely,
+// because its url comes after the text.
+func TruncateFormatted(s string, limit uint, parseMode string) string {
+	if uint(TextLength(s)) <= limit {
+		return s
+	}
+	return truncateFormatted(s, int(limit), parseMode)
+}
+
+// truncateFormatted is TruncateFormatted which closes the formatting
+// left open in the text even if the text fits, so that a prefix
+// of the formatted text can be passed.
+func truncateFormatted(s string, limit int, parseMode string) string {
+	switch parseMode {
+	case PARSE_MODE_HTML:
+		return truncateHtml(s, limit)
+	case PARSE_MODE_MARKDOWN_V2:
+		return truncateMarkdownV2(s, limit)
+	}
+	length := 0
+	for i, r := range s {
+		length += utf16.RuneLen(r)
+		if length > limit {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// formattedTruncator accumulates the tokens of the formatted text
+// while they fit in the limit along with the closing markup
+// of the open ones.
+type formattedTruncator struct {
+	limit  int
+	out    strings.Builder
+	length int
+	// The markup closing the open formatting, innermost last.
+	closing []string
+}
+
+func (t *formattedTruncator) closingLength() int {
+	n := 0
+	for _, c := range t.closing {
+		n += TextLength(c)
+	}
+	return n
+}
+
+// fits tells whether the token can be added given the closing
+// markup which is going to be open after it.
+func (t *formattedTruncator) fits(token string, closingLength int) bool {
+	return t.length+TextLength(token)+closingLength <= t.limit
+}
+
+func (t *formattedTruncator) add(token string) {
+	t.out.WriteString(token)
+	t.length += TextLength(token)
+}
+
+func (t *formattedTruncator) result() string {
+	for i := len(t.closing) - 1; i >= 0; i-- {
+		t.out.WriteString(t.closing[i])
+	}
+	return t.out.String()
+}
+
+func (t *formattedTruncator) removeClosing(c string) {
+	for i := len(t.closing) - 1; i >= 0; i-- {
+		if t.closing[i] == c {
+			t.closing = append(t.closing[:i], t.closing[i+1:]...)
+			return
+		}
+	}
+}
+
+func truncateHtml(s string, limit int) string {
+	t := &formattedTruncator{limit: limit}
+	for i := 0; i < len(s); {
+		token := nextRune(s[i:])
+		closingLength := t.closingLength()
+		var openTag, closeTag string
+		switch s[i] {
+		case '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				token = s[i : i+end+1]
+				name := htmlTagName(token)
+				if strings.HasPrefix(token, "</") {
+					closeTag = "</" + name + ">"
+					closingLength -= TextLength(closeTag)
+				} else {
+					openTag = "</" + name + ">"
+					closingLength += TextLength(openTag)
+				}
+			}
+		case '&':
+			if end := strings.IndexByte(s[i:], ';'); end > 0 && !strings.ContainsAny(s[i+1:i+end], " &<") {
+				token = s[i : i+end+1]
+			}
+		}
+		if !t.fits(token, closingLength) {
+			break
+		}
+		t.add(token)
+		if openTag != "" {
+			t.closing = append(t.closing, openTag)
+		}
+		if closeTag != "" {
+			t.removeClosing(closeTag)
+		}
+		i += len(token)
+	}
+	return t.result()
+}
+
+func htmlTagName(tag string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(tag, "<"), "/")
+	if end := strings.IndexAny(name, " \t\n/>"); end >= 0 {
+		name = name[:end]
+	}
+	return strings.ToLower(name)
+}
+
+var markdownV2Markers = []string{"```", "`", "||", "__", "*", "_", "~"}
+
+func truncateMarkdownV2(s string, limit int) string {
+	t := &formattedTruncator{limit: limit}
+	// The code marker while inside of a code entity, where only
+	// the backslash and the backtick are special.
+	code := ""
+	// The state at the start of the link being added, restored
+	// when the link doesn't fit. `linkUrl` is true after `](`.
+	inLink, linkUrl := false, false
+	var linkOut string
+	var linkLength int
+	var linkClosing []string
+
+	for i := 0; i < len(s); {
+		token := nextRune(s[i:])
+		closing := t.closing
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			token = s[i:i+1] + nextRune(s[i+1:])
+		case code != "":
+			if strings.HasPrefix(s[i:], code) {
+				token = code
+				closing = closing[:len(closing)-1]
+			}
+		case inLink && !linkUrl && strings.HasPrefix(s[i:], "]("):
+			token = "]("
+		case inLink && linkUrl:
+			// Only `)` and `\` are special in the url.
+		case !inLink && (s[i] == '[' || strings.HasPrefix(s[i:], "![")):
+			if s[i] == '!' {
+				token = "!["
+			}
+		default:
+			for _, marker := range markdownV2Markers {
+				if strings.HasPrefix(s[i:], marker) {
+					token = marker
+					if marker == "```" || marker == "`" || !containsString(closing, marker) {
+						closing = append(append([]string{}, closing...), marker)
+					} else {
+						closing = removeString(closing, marker)
+					}
+					break
+				}
+			}
+		}
+		closingLength := 0
+		for _, c := range closing {
+			closingLength += TextLength(c)
+		}
+		if !t.fits(token, closingLength) {
+			break
+		}
+		if !inLink && (token == "[" || token == "![") && code == "" {
+			inLink, linkUrl = true, false
+			linkOut, linkLength = t.out.String(), t.length
+			linkClosing = append([]string{}, t.closing...)
+		} else if inLink && token == "](" {
+			linkUrl = true
+		} else if inLink && linkUrl && token == ")" {
+			inLink, linkUrl = false, false
+		}
+		if code == "" && (token == "```" || token == "`") && len(closing) > len(t.closing) {
+			code = token
+		} else if code != "" && token == code {
+			code = ""
+		}
+		t.add(token)
+		t.closing = closing
+		i += len(token)
+	}
+	if inLink {
+		// The link is either cut or not closed in the text.
+		t.out.Reset()
+		t.out.WriteString(linkOut)
+		t.length = linkLength
+		t.closing = linkClosing
+	}
+	return t.result()
+}
+
+func nextRune(s string) string {
+	_, size := utf8.DecodeRuneInString(s)
+	return s[:size]
+}
+
+func containsString(a []string, s string) bool {
+	for _, aa := range a {
+		if aa == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(a []string, s string) []string {
+	for i := len(a) - 1; i >= 0; i-- {
+		if a[i] == s {
+			return append(append([]string{}, a[:i]...), a[i+1:]...)
+		}
+	}
+	return a
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestEscapeForParseMode(t *testing.T) {
+	s := `a<b> & "c" *d_e* [f](g) 1.5!`
+	assert.Equal(t, s, EscapeForParseMode(s, PARSE_MODE_NONE))
+	assert.Equal(t, `a&lt;b&gt; &amp; "c" *d_e* [f](g) 1.5!`, EscapeForParseMode(s, PARSE_MODE_HTML))
+	assert.Equal(t, `a<b\> & "c" \*d\_e\* \[f\]\(g\) 1\.5\!`, EscapeForParseMode(s, PARSE_MODE_MARKDOWN_V2))
+	assert.Equal(t, `a\\b`, EscapeForParseMode(`a\b`, PARSE_MODE_MARKDOWN_V2))
+}
+
+func TestTextLength(t *testing.T) {
+	assert.Equal(t, 5, TextLength("Hello"))
+	assert.Equal(t, 4, TextLength("Ключ"))
+	assert.Equal(t, 4, TextLength("a📎b"))
+}
+
+func TestTruncateFormatted(t *testing.T) {
+	cases := []struct {
+		parseMode string
+		s         string
+		limit     uint
+		exp       string
+	}{
+		{PARSE_MODE_NONE, "Hello world", 5, "Hello"},
+		{PARSE_MODE_NONE, "Hello", 5, "Hello"},
+		{PARSE_MODE_NONE, "a😀b", 2, "a"},
+		{PARSE_MODE_HTML, "<b>😀😀</b>", 9, "<b>😀</b>"},
+
+		{PARSE_MODE_HTML, "<b>Hello</b>", 12, "<b>Hello</b>"},
+		// The closing tag is kept within the limit.
+		{PARSE_MODE_HTML, "<b>Hello</b> world", 12, "<b>Hello</b>"},
+		{PARSE_MODE_HTML, "<b>Hello</b> world", 11, "<b>Hell</b>"},
+		// Never inside of a tag.
+		{PARSE_MODE_HTML, `ab <a href="http://x">link</a>`, 10, "ab "},
+		{PARSE_MODE_HTML, `<b><i>bold italic</i></b> text`, 18, "<b><i>bold</i></b>"},
+		// Never inside of an entity.
+		{PARSE_MODE_HTML, "a &amp; b", 4, "a "},
+		{PARSE_MODE_HTML, "a &amp; b", 7, "a &amp;"},
+
+		{PARSE_MODE_MARKDOWN_V2, `*bold* text`, 7, `*bold* `},
+		{PARSE_MODE_MARKDOWN_V2, `*bold* text`, 5, `*bol*`},
+		// Never inside of an escape sequence.
+		{PARSE_MODE_MARKDOWN_V2, `1\.5\.`, 2, `1`},
+		{PARSE_MODE_MARKDOWN_V2, `1\.5\.`, 3, `1\.`},
+		{PARSE_MODE_MARKDOWN_V2, `_a __b__ c_ d`, 10, `_a __b__ _`},
+		{PARSE_MODE_MARKDOWN_V2, "`code *x*` y", 8, "`code *`"},
+		// A link which doesn't fit is dropped.
+		{PARSE_MODE_MARKDOWN_V2, `ab [*link*](http://x) c`, 15, `ab `},
+		{PARSE_MODE_MARKDOWN_V2, `ab [*link*](http://x_y) c`, 23, `ab [*link*](http://x_y)`},
+	}
+	for _, c := range cases {
+		truncated := TruncateFormatted(c.s, c.limit, c.parseMode)
+		assert.Equal(t, c.exp, truncated, "%s %q %d", c.parseMode, c.s, c.limit)
+		assert.LessOrEqual(t, uint(utf8.RuneCountInString(truncated)), c.limit)
+	}
+}
+
+func TestParseModeHtml(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "<b>{subject}</b>\\n\\n{body}"
+	telegramConfig.messageParseMode = PARSE_MODE_HTML
+	telegramConfig.messageLengthToSendAsFile = 61
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "<script> & co")
+	m.SetBody("text/plain", strings.Repeat("a&b ", 30))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	exp := "<b>&lt;script&gt; &amp; co</b>\n" +
+		"\n" +
+		"a&amp;b a&amp;b\n" +
+		"\n" +
+		"[truncated]"
+	assert.Equal(t, exp, h.RequestMessages[0])
+	assert.Equal(t, []string{PARSE_MODE_HTML, PARSE_MODE_HTML}, h.RequestMessagesFormValues("parse_mode"))
+}
+
+func TestParseModeMarkdownV2(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "*{subject}*\\n{from}\\n\\n{body}"
+	telegramConfig.messageParseMode = PARSE_MODE_MARKDOWN_V2
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Disk 95.5% full!")
+	m.SetBody("text/plain", "Check /var/log_*")
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	exp := "*Disk 95\\.5% full\\!*\n" +
+		"from@test\n" +
+		"\n" +
+		"Check /var/log\\_\\*"
+	assert.Equal(t, exp, h.RequestMessages[0])
+	assert.Equal(t, PARSE_MODE_MARKDOWN_V2, h.RequestMessagesFormValues("parse_mode")[0])
+}
+
+func TestParseModeNotSentByDefault(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetBody("text/plain", "<b>hi</b>")
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	assert.Contains(t, h.RequestMessages[0], "<b>hi</b>")
+	assert.False(t, h.RequestMessagesForms[0].Has("parse_mode"))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// TelegramRateLimiter is a token bucket limiter of the requests to
+// the Telegram API, shared by all save workers.
+//
+// See: https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+type TelegramRateLimiter struct {
+	perChat rate.Limit
+	global  *rate.Limiter
+	chats   map[string]*rate.Limiter
+	mu      sync.Mutex
+}
+
+// NewTelegramRateLimiter creates a limiter allowing perChat requests
+// per second to a single chat and global requests per second overall.
+// 0 disables the corresponding limit.
+func NewTelegramRateLimiter(perChat float64, global float64) *TelegramRateLimiter {
+	return &TelegramRateLimiter{
+		perChat: limitOrInf(perChat),
+		global:  rate.NewLimiter(limitOrInf(global), burstOf(global)),
+		chats:   map[string]*rate.Limiter{},
+	}
+}
+
+// Wait blocks until a request to the chat is allowed. A nil limiter
+// doesn't limit anything.
+func (l *TelegramRateLimiter) Wait(chatId string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	chat, ok := l.chats[chatId]
+	if !ok {
+		// No bursts within a chat, those are the first to hit the flood control.
+		chat = rate.NewLimiter(l.perChat, 1)
+		l.chats[chatId] = chat
+	}
+	l.mu.Unlock()
+
+	// Wait never fails with a background context and a non-zero burst.
+	_ = chat.Wait(context.Background())
+	_ = l.global.Wait(context.Background())
+}
+
+func limitOrInf(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+func burstOf(perSecond float64) int {
+	if perSecond < 1 || math.IsInf(perSecond, 1) {
+		return 1
+	}
+	return int(math.Ceil(perSecond))
+}
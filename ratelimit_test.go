@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelegramRateLimiterPerChat(t *testing.T) {
+	l := NewTelegramRateLimiter(20, 0)
+
+	start := time.Now()
+	l.Wait("42")
+	l.Wait("142")
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+
+	l.Wait("42")
+	l.Wait("42")
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestTelegramRateLimiterGlobal(t *testing.T) {
+	l := NewTelegramRateLimiter(0, 20)
+
+	// The global limit allows bursts.
+	start := time.Now()
+	for n := 0; n < 20; n++ {
+		l.Wait(fmt.Sprintf("%d", n))
+	}
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+
+	l.Wait("42")
+	l.Wait("142")
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestTelegramRateLimiterDisabled(t *testing.T) {
+	var nilLimiter *TelegramRateLimiter
+	l := NewTelegramRateLimiter(0, 0)
+
+	start := time.Now()
+	for n := 0; n < 100; n++ {
+		l.Wait("42")
+		nilLimiter.Wait("42")
+	}
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestParseTelegramRetryAfter(t *testing.T) {
+	body := []byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5",` +
+		`"parameters":{"retry_after":5}}`)
+	assert.Equal(t, 5*time.Second, ParseTelegramRetryAfter(429, body))
+	assert.Equal(t, time.Duration(0), ParseTelegramRetryAfter(400, body))
+	assert.Equal(t, time.Duration(0), ParseTelegramRetryAfter(429, []byte("Error")))
+}
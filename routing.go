@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// TelegramRoute maps the recipient addresses matching the pattern
+// to a list of Telegram chat ids.
+//
+// Supported patterns:
+//   - `ops@alerts.local` -- an exact address;
+//   - `@alerts.local` -- any address of the domain;
+//   - `ops-*@alerts.local` -- a wildcard, `*` matches any chars but `@`, `?` -- a single one;
+//   - `/^ops-(db|web)@alerts\.local$/` -- a regular expression.
+//
+// Matching is case-insensitive.
+type TelegramRoute struct {
+	pattern string
+	re      *regexp.Regexp
+	chatIds []string
+	// Send the messages without a notification.
+	silent bool
+	// Forbid forwarding and saving the messages and their attachments.
+	protectContent bool
+}
+
+var ErrNoRoute = errors.New("no Telegram route for the recipient")
+
+func NewTelegramRoute(pattern string, chatIds []string) (*TelegramRoute, error) {
+	pattern = strings.TrimSpace(pattern)
+	re, err := CompileAddressPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	cleanChatIds := []string{}
+	for _, chatId := range chatIds {
+		chatId = strings.TrimSpace(chatId)
+		if chatId != "" {
+			if err := ValidateChatId(chatId); err != nil {
+				return nil, fmt.Errorf("Route %q: %s", pattern, err)
+			}
+			cleanChatIds = append(cleanChatIds, chatId)
+		}
+	}
+	if len(cleanChatIds) == 0 {
+		return nil, fmt.Errorf("Route %q has no chat ids", pattern)
+	}
+	return &TelegramRoute{pattern: pattern, re: re, chatIds: cleanChatIds}, nil
+}
+
+// SplitChatThread splits a chat id in the form of `chatid:threadid`
+// into the chat id and the forum topic (`message_thread_id`)
+// of a supergroup, which is empty for the plain chat ids.
+func SplitChatThread(chatId string) (string, string) {
+	chat, thread, _ := strings.Cut(chatId, ":")
+	return chat, thread
+}
+
+func ValidateChatId(chatId string) error {
+	chat, thread := SplitChatThread(chatId)
+	if chat == "" {
+		return fmt.Errorf("Invalid chat id %q: the chat is empty", chatId)
+	}
+	if strings.Contains(chatId, ":") {
+		if id, err := strconv.ParseInt(thread, 10, 64); err != nil || id <= 0 {
+			return fmt.Errorf("Invalid chat id %q: the thread id must be a positive number", chatId)
+		}
+	}
+	return nil
+}
+
+// WithThreadId adds the thread to the chat ids which have none.
+func WithThreadId(chatIds []string, threadId int64) []string {
+	if threadId == 0 {
+		return chatIds
+	}
+	threadChatIds := []string{}
+	for _, chatId := range chatIds {
+		chatId = strings.TrimSpace(chatId)
+		if chatId != "" && !strings.Contains(chatId, ":") {
+			chatId = fmt.Sprintf("%s:%d", chatId, threadId)
+		}
+		threadChatIds = append(threadChatIds, chatId)
+	}
+	return threadChatIds
+}
+
+// CompileAddressPattern compiles an address pattern of a route
+// to a case-insensitive regular expression. The wildcards don't
+// match `@`, so that the local part and the domain are matched
+// separately.
+func CompileAddressPattern(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimSpace(pattern)
+	var expr string
+	switch {
+	case pattern == "":
+		return nil, errors.New("empty route pattern")
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		expr = pattern[1 : len(pattern)-1]
+	case strings.HasPrefix(pattern, "@"):
+		expr = "^[^@]*" + regexp.QuoteMeta(pattern) + "$"
+	case strings.ContainsAny(pattern, "*?"):
+		expr = "^" + strings.NewReplacer(
+			`\*`, "[^@]*",
+			`\?`, "[^@]",
+		).Replace(regexp.QuoteMeta(pattern)) + "$"
+	default:
+		expr = "^" + regexp.QuoteMeta(pattern) + "$"
+	}
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid route pattern %q: %s", pattern, err)
+	}
+	return re, nil
+}
+
+// AddressPatterns is a list of compiled address patterns.
+type AddressPatterns []*regexp.Regexp
+
+func (p AddressPatterns) Matches(address string) bool {
+	for _, re := range p {
+		if re.MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAcceptedRecipients parses a comma-separated list of the recipient
+// domains and addresses. A domain (`alerts.local`, `*.alerts.local`)
+// matches all of its addresses, the rest are the route patterns.
+// Returns nil when the list is empty.
+func ParseAcceptedRecipients(s string) (AddressPatterns, error) {
+	var patterns AddressPatterns
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, "@") && !strings.HasPrefix(pattern, "/") {
+			pattern = "*@" + pattern
+		}
+		re, err := CompileAddressPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// ParseTelegramRoutes parses routes in the form of
+// `pattern=chatid1,chatid2;pattern2=chatid3:threadid`.
+func ParseTelegramRoutes(s string) ([]*TelegramRoute, error) {
+	routes := []*TelegramRoute{}
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid route %q: expected `pattern=chatid1,chatid2`", entry)
+		}
+		route, err := NewTelegramRoute(entry[:i], strings.Split(entry[i+1:], ","))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (r *TelegramRoute) Matches(address string) bool {
+	return r.re.MatchString(address)
+}
+
+// MatchRoute returns the first route matching the recipient or nil.
+func MatchRoute(rcpt mail.Address, telegramConfig *TelegramConfig) *TelegramRoute {
+	address := rcpt.String()
+	for _, route := range telegramConfig.telegramRoutes {
+		if route.Matches(address) {
+			return route
+		}
+	}
+	return nil
+}
+
+// RouteChatIds returns the chat ids of the first route matching
+// the recipient, falling back to the default `telegramChatIds`.
+func RouteChatIds(rcpt mail.Address, telegramConfig *TelegramConfig) ([]string, error) {
+	if route := MatchRoute(rcpt, telegramConfig); route != nil {
+		return route.chatIds, nil
+	}
+	if telegramConfig.telegramChatIds == "" {
+		return nil, ErrNoRoute
+	}
+	return strings.Split(telegramConfig.telegramChatIds, ","), nil
+}
+
+// RouteEnvelopeChatIds returns the deduplicated chat ids the email
+// should be sent to according to all of its recipients.
+func RouteEnvelopeChatIds(rcptTo []mail.Address, telegramConfig *TelegramConfig) ([]string, error) {
+	chatIds := []string{}
+	seen := map[string]bool{}
+	for _, rcpt := range rcptTo {
+		rcptChatIds, err := RouteChatIds(rcpt, telegramConfig)
+		if err != nil {
+			continue
+		}
+		for _, chatId := range rcptChatIds {
+			if !seen[chatId] {
+				seen[chatId] = true
+				chatIds = append(chatIds, chatId)
+			}
+		}
+	}
+	if len(chatIds) == 0 {
+		// Might happen when the routes have been reloaded after
+		// the recipients were validated. Retrying won't help.
+		return nil, &RejectedError{
+			message: fmt.Sprintf("%s: %s", ErrNoRoute, JoinEmailAddresses(rcptTo)),
+		}
+	}
+	return chatIds, nil
+}
+
+// RouteChatOptions returns the delivery options of the chat
+// by the routes of the recipients the chat is routed to.
+// The email is silent only if all of these routes are silent,
+// and protected if any of them is protected. The chats
+// which aren't routed to (e.g. those of a rule) get no options.
+func RouteChatOptions(
+	rcptTo []mail.Address,
+	chatId string,
+	telegramConfig *TelegramConfig,
+) (silent bool, protectContent bool) {
+	routed := false
+	silent = true
+	for _, rcpt := range rcptTo {
+		route := MatchRoute(rcpt, telegramConfig)
+		if route == nil {
+			if telegramConfig.telegramChatIds != "" &&
+				slices.Contains(strings.Split(telegramConfig.telegramChatIds, ","), chatId) {
+				routed = true
+				silent = false
+			}
+			continue
+		}
+		if slices.Contains(route.chatIds, chatId) {
+			routed = true
+			silent = silent && route.silent
+			protectContent = protectContent || route.protectContent
+		}
+	}
+	return routed && silent, protectContent
+}
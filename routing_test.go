@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func mustParseTelegramRoutes(s string) []*TelegramRoute {
+	routes, err := ParseTelegramRoutes(s)
+	if err != nil {
+		panic(err)
+	}
+	return routes
+}
+
+func TestTelegramRoutePatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		address string
+		matches bool
+	}{
+		{"ops@alerts.local", "ops@alerts.local", true},
+		{"ops@alerts.local", "OPS@Alerts.Local", true},
+		{"ops@alerts.local", "xops@alerts.local", false},
+		{"ops@alerts.local", "ops@alerts.localhost", false},
+		{"@alerts.local", "billing@alerts.local", true},
+		{"@alerts.local", "billing@sub.alerts.local", false},
+		{"*@*.alerts.local", "billing@sub.alerts.local", true},
+		{"ops-?@alerts.local", "ops-1@alerts.local", true},
+		{"ops-?@alerts.local", "ops-12@alerts.local", false},
+		{"ops.*@alerts.local", "opsx@alerts.local", false},
+		{"*@alerts.local", `"x@alerts.local>"@evil.com`, false},
+		{"ops-*", "ops-1@evil.com", false},
+		{`/^(db|web)-\d+@alerts\.local$/`, "db-12@alerts.local", true},
+		{`/^(db|web)-\d+@alerts\.local$/`, "mq-12@alerts.local", false},
+	}
+	for _, c := range cases {
+		route, err := NewTelegramRoute(c.pattern, []string{"42"})
+		assert.NoError(t, err)
+		assert.Equal(t, c.matches, route.Matches(c.address), "%s ~ %s", c.pattern, c.address)
+	}
+}
+
+func TestParseTelegramRoutes(t *testing.T) {
+	routes, err := ParseTelegramRoutes(" ops@alerts.local = 1, 2 ;@billing.local=3;")
+	assert.NoError(t, err)
+	assert.Len(t, routes, 2)
+	assert.Equal(t, []string{"1", "2"}, routes[0].chatIds)
+	assert.Equal(t, []string{"3"}, routes[1].chatIds)
+
+	routes, err = ParseTelegramRoutes("ops@alerts.local=-1001:7,-1002")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-1001:7", "-1002"}, routes[0].chatIds)
+
+	_, err = ParseTelegramRoutes("ops@alerts.local=-1001:x")
+	assert.Error(t, err)
+	_, err = ParseTelegramRoutes("ops@alerts.local")
+	assert.Error(t, err)
+	_, err = ParseTelegramRoutes("ops@alerts.local=")
+	assert.Error(t, err)
+	_, err = ParseTelegramRoutes("/(/=42")
+	assert.Error(t, err)
+}
+
+func TestRouteEnvelopeChatIds(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = ""
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=1,2;@alerts.local=2,3")
+
+	rcptTo := []mail.Address{
+		{User: "ops", Host: "alerts.local"},
+		{User: "billing", Host: "alerts.local"},
+		{User: "nobody", Host: "test"},
+	}
+	chatIds, err := RouteEnvelopeChatIds(rcptTo, telegramConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, chatIds)
+
+	_, err = RouteEnvelopeChatIds(rcptTo[2:], telegramConfig)
+	assert.Error(t, err)
+
+	telegramConfig.telegramChatIds = "42"
+	chatIds, err = RouteEnvelopeChatIds(rcptTo[2:], telegramConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"42"}, chatIds)
+}
+
+func TestRoutingByRecipient(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = ""
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=1;billing@alerts.local=2,3")
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"billing@alerts.local"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, h.RequestMessagesFormValues("chat_id"))
+}
+
+func TestRoutingRejectsUnroutedRecipient(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = ""
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=1")
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"billing@alerts.local"}, []byte(`hi`))
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "550 "), err.Error())
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestRoutesAddedOnReloadRejectUnroutedRecipient(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	d := startSmtp(smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = ""
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("ops@alerts.local=1")
+	d.ReloadTelegramConfig(telegramConfig)
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"billing@alerts.local"}, []byte(`hi`))
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "550 "), err.Error())
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestParseAcceptedRecipients(t *testing.T) {
+	patterns, err := ParseAcceptedRecipients("alerts.local, *.example.com,ops@billing.local")
+	assert.NoError(t, err)
+	assert.True(t, patterns.Matches("anyone@alerts.local"))
+	assert.True(t, patterns.Matches("anyone@ALERTS.local"))
+	assert.True(t, patterns.Matches("anyone@mail.example.com"))
+	assert.True(t, patterns.Matches("ops@billing.local"))
+	assert.False(t, patterns.Matches("anyone@example.com"))
+	assert.False(t, patterns.Matches("dev@billing.local"))
+	assert.False(t, patterns.Matches("anyone@alerts.local.evil"))
+
+	patterns, err = ParseAcceptedRecipients("")
+	assert.NoError(t, err)
+	assert.Nil(t, patterns)
+
+	_, err = ParseAcceptedRecipients("/(/")
+	assert.Error(t, err)
+}
+
+func TestRelayDeniedForNotAcceptedRecipient(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAcceptedRecipients, _ = ParseAcceptedRecipients("alerts.local,ops@billing.local")
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"dev@billing.local"}, []byte(`hi`))
+	assert.Equal(t, 550, smtpErrorCode(err))
+	assert.Contains(t, err.Error(), "Relay access denied")
+	assert.Len(t, h.RequestMessages, 0)
+
+	err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test",
+		[]string{"db@alerts.local", "ops@billing.local"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+func TestRelayDeniedForQuotedLocalPart(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAcceptedRecipients, _ = ParseAcceptedRecipients("alerts.local")
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("from@test"))
+	id, err := c.Text.Cmd(`RCPT TO:<"x@alerts.local>"@evil.com>`)
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	code, msg, err := c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	assert.Error(t, err)
+	assert.Equal(t, 550, code)
+	assert.Contains(t, msg, "Relay access denied")
+
+	id, err = c.Text.Cmd(`RCPT TO:<x@alerts.local`)
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	code, _, _ = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	assert.Equal(t, 501, code)
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestForumTopics(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = "-1001:7,142"
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Deploy")
+	m.SetBody("text/plain", "Done")
+	m.Attach("log.txt", goMailBody([]byte("TXT")))
+	m.Attach("1.jpg", goMailBody([]byte("JPG1")))
+	m.Attach("2.jpg", goMailBody([]byte("JPG2")))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	assert.Equal(t, []string{"-1001", "142"}, h.RequestMessagesFormValues("chat_id"))
+	assert.Equal(t, []string{"7", ""}, h.RequestMessagesFormValues("message_thread_id"))
+	assert.False(t, h.RequestMessagesForms[1].Has("message_thread_id"))
+	assert.Equal(t, []string{"7", "7", "7", "", "", ""}, h.RequestDocumentsThreadIds)
+}
+
+func TestRouteChatOptions(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = "42"
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("low@alerts.local=1,2;secret@alerts.local=2,3")
+	telegramConfig.telegramRoutes[0].silent = true
+	telegramConfig.telegramRoutes[1].protectContent = true
+
+	low := mail.Address{User: "low", Host: "alerts.local"}
+	secret := mail.Address{User: "secret", Host: "alerts.local"}
+	other := mail.Address{User: "other", Host: "test"}
+	cases := []struct {
+		rcptTo         []mail.Address
+		chatId         string
+		silent         bool
+		protectContent bool
+	}{
+		{[]mail.Address{low}, "1", true, false},
+		{[]mail.Address{low, secret}, "1", true, false},
+		// Any of the routes which isn't silent makes a notification.
+		{[]mail.Address{low, secret}, "2", false, true},
+		{[]mail.Address{secret}, "3", false, true},
+		{[]mail.Address{low, other}, "42", false, false},
+		// The chats of the rules aren't routed to.
+		{[]mail.Address{low}, "7", false, false},
+	}
+	for _, c := range cases {
+		silent, protectContent := RouteChatOptions(c.rcptTo, c.chatId, telegramConfig)
+		assert.Equal(t, c.silent, silent, "%v %s", c.rcptTo, c.chatId)
+		assert.Equal(t, c.protectContent, protectContent, "%v %s", c.rcptTo, c.chatId)
+	}
+}
+
+func TestRouteDeliveryOptions(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = ""
+	telegramConfig.telegramRoutes = mustParseTelegramRoutes("low@alerts.local=1;secret@alerts.local=2")
+	telegramConfig.telegramRoutes[0].silent = true
+	telegramConfig.telegramRoutes[1].protectContent = true
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "low@alerts.local", "secret@alerts.local")
+	m.SetHeader("Subject", "Report")
+	m.SetBody("text/plain", "Attached")
+	m.Attach("report.txt", goMailBody([]byte("TXT")))
+	m.Attach("1.jpg", goMailBody([]byte("JPG1")))
+	m.Attach("2.jpg", goMailBody([]byte("JPG2")))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	assert.Equal(t, []string{"1", "2"}, h.RequestMessagesFormValues("chat_id"))
+	assert.Equal(t, []string{"true", "false"}, h.RequestMessagesFormValues("disable_notification"))
+	assert.Equal(t, []string{"false", "true"}, h.RequestMessagesFormValues("protect_content"))
+	assert.Equal(t, []string{"false", "false", "false", "true", "true", "true"}, h.RequestDocumentsProtectContent)
+}
+
+func TestSplitChatThread(t *testing.T) {
+	chat, thread := SplitChatThread("-1001:7")
+	assert.Equal(t, "-1001", chat)
+	assert.Equal(t, "7", thread)
+	chat, thread = SplitChatThread("@channel")
+	assert.Equal(t, "@channel", chat)
+	assert.Equal(t, "", thread)
+
+	assert.NoError(t, ValidateChatId("-1001:7"))
+	assert.Error(t, ValidateChatId("-1001:"))
+	assert.Error(t, ValidateChatId("-1001:-7"))
+	assert.Error(t, ValidateChatId(":7"))
+
+	assert.Equal(t, []string{"1:3", "2:5"}, WithThreadId([]string{"1", "2:5"}, 3))
+	assert.Equal(t, []string{"1"}, WithThreadId([]string{"1"}, 0))
+}
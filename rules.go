@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	RULE_ACTION_DELIVER = "deliver"
+	RULE_ACTION_DROP    = "drop"
+	RULE_ACTION_REJECT  = "reject"
+)
+
+// TelegramRuleConfig is a rule as it is written in the configuration.
+// All of the specified regular expressions must match for the rule
+// to be applied.
+type TelegramRuleConfig struct {
+	From    string            `json:"from" yaml:"from"`
+	Subject string            `json:"subject" yaml:"subject"`
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Body    string            `json:"body" yaml:"body"`
+
+	// One of `deliver` (default), `drop` or `reject`.
+	Action string `json:"action" yaml:"action"`
+	// Modifiers of the `deliver` action.
+	ChatIds        []string `json:"chat_ids" yaml:"chat_ids"`
+	Template       string   `json:"template" yaml:"template"`
+	Silent         bool     `json:"silent" yaml:"silent"`
+	ProtectContent bool     `json:"protect_content" yaml:"protect_content"`
+	// The response of the `reject` action.
+	RejectMessage string `json:"reject_message" yaml:"reject_message"`
+}
+
+type TelegramRule struct {
+	from    *regexp.Regexp
+	subject *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	body    *regexp.Regexp
+
+	action         string
+	chatIds        []string
+	template       string
+	silent         bool
+	protectContent bool
+	rejectMessage  string
+}
+
+// TelegramRuleVerdict is the outcome of the rules applied to an email.
+// The zero value means delivering the email as usual.
+type TelegramRuleVerdict struct {
+	action         string
+	chatIds        []string
+	template       string
+	silent         bool
+	protectContent bool
+	rejectMessage  string
+}
+
+// RejectedError is a permanent delivery error, the email must not be retried.
+type RejectedError struct {
+	message string
+}
+
+func (e *RejectedError) Error() string {
+	return e.message
+}
+
+func IsRejectedError(err error) bool {
+	var rejectedError *RejectedError
+	return errors.As(err, &rejectedError)
+}
+
+func NewTelegramRule(ruleConfig *TelegramRuleConfig) (*TelegramRule, error) {
+	var err error
+	rule := &TelegramRule{
+		headers:        map[string]*regexp.Regexp{},
+		action:         ruleConfig.Action,
+		chatIds:        ruleConfig.ChatIds,
+		template:       ruleConfig.Template,
+		silent:         ruleConfig.Silent,
+		protectContent: ruleConfig.ProtectContent,
+		rejectMessage:  ruleConfig.RejectMessage,
+	}
+	for _, chatId := range rule.chatIds {
+		if err := ValidateChatId(chatId); err != nil {
+			return nil, err
+		}
+	}
+	if rule.from, err = compileRuleRegexp("from", ruleConfig.From); err != nil {
+		return nil, err
+	}
+	if rule.subject, err = compileRuleRegexp("subject", ruleConfig.Subject); err != nil {
+		return nil, err
+	}
+	if rule.body, err = compileRuleRegexp("body", ruleConfig.Body); err != nil {
+		return nil, err
+	}
+	for name, expr := range ruleConfig.Headers {
+		if rule.headers[name], err = compileRuleRegexp("header "+name, expr); err != nil {
+			return nil, err
+		}
+	}
+	switch rule.action {
+	case "":
+		rule.action = RULE_ACTION_DELIVER
+	case RULE_ACTION_DELIVER, RULE_ACTION_DROP, RULE_ACTION_REJECT:
+	default:
+		return nil, fmt.Errorf("Unknown rule action %q", rule.action)
+	}
+	if rule.action == RULE_ACTION_REJECT && rule.rejectMessage == "" {
+		rule.rejectMessage = "Rejected by a rule"
+	}
+	return rule, nil
+}
+
+func compileRuleRegexp(name string, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rule %s regexp %q: %s", name, expr, err)
+	}
+	return re, nil
+}
+
+// ParseTelegramRules parses a JSON list of rules.
+func ParseTelegramRules(s string) ([]*TelegramRule, error) {
+	if strings.TrimSpace(s) == "" {
+		return []*TelegramRule{}, nil
+	}
+	ruleConfigs := []*TelegramRuleConfig{}
+	if err := json.Unmarshal([]byte(s), &ruleConfigs); err != nil {
+		return nil, fmt.Errorf("Unable to parse rules: %s", err)
+	}
+	return NewTelegramRules(ruleConfigs)
+}
+
+func NewTelegramRules(ruleConfigs []*TelegramRuleConfig) ([]*TelegramRule, error) {
+	rules := []*TelegramRule{}
+	for i, ruleConfig := range ruleConfigs {
+		rule, err := NewTelegramRule(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Rule #%d: %s", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *TelegramRule) Matches(e *mail.Envelope, env *enmime.Envelope, body string) bool {
+	if r.from != nil && !r.from.MatchString(e.MailFrom.String()) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(env.GetHeader("subject")) {
+		return false
+	}
+	for name, re := range r.headers {
+		matched := false
+		for _, value := range env.GetHeaderValues(name) {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.body != nil && !r.body.MatchString(body) {
+		return false
+	}
+	return true
+}
+
+// ApplyTelegramRules returns the verdict of the first matching rule.
+func ApplyTelegramRules(
+	e *mail.Envelope,
+	env *enmime.Envelope,
+	body string,
+	telegramConfig *TelegramConfig,
+) *TelegramRuleVerdict {
+	for _, rule := range telegramConfig.telegramRules {
+		if rule.Matches(e, env, body) {
+			return &TelegramRuleVerdict{
+				action:         rule.action,
+				chatIds:        rule.chatIds,
+				template:       rule.template,
+				silent:         rule.silent,
+				protectContent: rule.protectContent,
+				rejectMessage:  rule.rejectMessage,
+			}
+		}
+	}
+	return &TelegramRuleVerdict{action: RULE_ACTION_DELIVER}
+}
+
+// ApplyTelegramRulesBeforeSpooling returns the verdict of the rules
+// for the email which is about to be spooled. The email which can't
+// be parsed is spooled anyway, the delivery worker reports it.
+// Only the headers and the body are parsed, the attachments are
+// processed once the email is formatted for the delivery.
+func ApplyTelegramRulesBeforeSpooling(e *mail.Envelope, telegramConfig *TelegramConfig) *TelegramRuleVerdict {
+	if len(telegramConfig.telegramRules) == 0 {
+		return &TelegramRuleVerdict{action: RULE_ACTION_DELIVER}
+	}
+	env, err := enmime.NewParser(enmime.DisableTextConversion(true)).ReadEnvelope(e.NewReader())
+	if err != nil {
+		return &TelegramRuleVerdict{action: RULE_ACTION_DELIVER}
+	}
+	return ApplyTelegramRules(e, env, EmailBody(e, env), telegramConfig)
+}
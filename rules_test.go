@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseTelegramRules(s string) []*TelegramRule {
+	rules, err := ParseTelegramRules(s)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func TestParseTelegramRules(t *testing.T) {
+	rules, err := ParseTelegramRules(`[{"from": "^cron@", "action": "drop"}, {"subject": "x", "silent": true}]`)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+	assert.Equal(t, RULE_ACTION_DROP, rules[0].action)
+	assert.Equal(t, RULE_ACTION_DELIVER, rules[1].action)
+
+	_, err = ParseTelegramRules(`[{"action": "explode"}]`)
+	assert.EqualError(t, err, `Rule #1: Unknown rule action "explode"`)
+	_, err = ParseTelegramRules(`[{"headers": {"X-Priority": "("}}]`)
+	assert.Error(t, err)
+	_, err = ParseTelegramRules(`{}`)
+	assert.Error(t, err)
+}
+
+func sendRulesTestMail(t *testing.T, rules string, from string, msg string) (*SuccessHandler, error) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRules = mustParseTelegramRules(rules)
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, from, []string{"to@test"}, []byte(msg))
+	return h, err
+}
+
+func TestRuleDrop(t *testing.T) {
+	rules := `[{"from": "^cron@", "subject": "(?i)success", "action": "drop"}]`
+
+	h, err := sendRulesTestMail(t, rules, "cron@test", "Subject: Backup SUCCESS\r\n\r\nhi")
+	assert.NoError(t, err)
+	assert.Len(t, h.RequestMessages, 0)
+
+	h, err = sendRulesTestMail(t, rules, "cron@test", "Subject: Backup failed\r\n\r\nhi")
+	assert.NoError(t, err)
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+func TestRuleReject(t *testing.T) {
+	rules := `[{"body": "spam", "action": "reject", "reject_message": "No spam please"}]`
+
+	h, err := sendRulesTestMail(t, rules, "from@test", "Subject: hi\r\n\r\nsome spam")
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+	assert.Contains(t, err.Error(), "No spam please")
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestRuleDeliverModifiers(t *testing.T) {
+	rules := `[
+		{"headers": {"X-Priority": "^5"}, "chat_ids": ["7"], "template": "Low: {subject}", "silent": true},
+		{"headers": {"X-Priority": "^1"}, "chat_ids": ["8"], "protect_content": true}
+	]`
+
+	h, err := sendRulesTestMail(t, rules, "from@test", "Subject: hi\r\nX-Priority: 5 (Lowest)\r\n\r\nbody")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Low: hi"}, h.RequestMessages)
+	assert.Equal(t, []string{"7"}, h.RequestMessagesFormValues("chat_id"))
+	assert.Equal(t, []string{"true"}, h.RequestMessagesFormValues("disable_notification"))
+	assert.Equal(t, []string{"false"}, h.RequestMessagesFormValues("protect_content"))
+
+	h, err = sendRulesTestMail(t, rules, "from@test", "Subject: hi\r\nX-Priority: 1\r\n\r\nbody")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"8"}, h.RequestMessagesFormValues("chat_id"))
+	assert.Equal(t, []string{"false"}, h.RequestMessagesFormValues("disable_notification"))
+	assert.Equal(t, []string{"true"}, h.RequestMessagesFormValues("protect_content"))
+}
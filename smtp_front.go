@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/mail/rfc5321"
+)
+
+// The same as the default timeout of guerrilla.
+const smtpFrontTimeout = 30 * time.Second
+
+// The max length of an SMTP command line, including CRLF.
+const smtpFrontMaxCommandLength = 1024
+
+// guerrilla doesn't enforce the order of these, so all of them are
+// refused when the session isn't allowed to send emails.
+var smtpTransactionCommands = map[string]bool{"MAIL": true, "RCPT": true, "DATA": true}
+
+var (
+	errSmtpLineTooLong   = errors.New("line too long")
+	errSmtpAuthCancelled = errors.New("authentication cancelled")
+	errSmtpAuthSyntax    = errors.New("invalid base64")
+)
+
+// SmtpFront is an SMTP proxy listening in front of guerrilla, which has
+// no hooks for the features that need to intercept the SMTP session:
+//   - AUTH PLAIN/LOGIN and the routes allowed for the users;
+//   - requiring TLS before MAIL FROM;
+//   - the client IP access lists checked on connect;
+//   - the accepted recipients, guerrilla refuses the others with
+//     a temporary error.
+//
+// guerrilla can terminate TLS on its own and does so when the front
+// isn't needed. Otherwise the front has to read the session, AUTH
+// included, so STARTTLS and implicit TLS are terminated here.
+//
+// The commands the front doesn't care about are relayed to guerrilla
+// listening on a loopback address. The front passes a session token
+// as the client's address with XCLIENT, so the clients connecting
+// to guerrilla directly are refused by the `SmtpFront` processor.
+type SmtpFront struct {
+	smtpConfig  *SmtpConfig
+	backendAddr string
+	tlsConfig   *tls.Config
+	credentials *SmtpCredentials
+	// The routes the users are allowed to send emails to.
+	telegramConfigStore *atomic.Pointer[TelegramConfig]
+
+	listeners []net.Listener
+	// The number of listeners still accepting connections.
+	serving atomic.Int32
+	wg      sync.WaitGroup
+	// The sessions by their tokens.
+	sessions sync.Map
+}
+
+// SmtpFrontRequired tells whether the SMTP config has any features
+// which guerrilla can't provide on its own.
+func SmtpFrontRequired(smtpConfig *SmtpConfig) bool {
+	return smtpConfig.smtpRequireTls ||
+		smtpConfig.smtpAuthFile != "" ||
+		smtpConfig.smtpAccessList != nil ||
+		smtpConfig.smtpAcceptedRecipients != nil
+}
+
+func NewSmtpFront(
+	smtpConfig *SmtpConfig,
+	telegramConfigStore *atomic.Pointer[TelegramConfig],
+	backendAddr string,
+) (*SmtpFront, error) {
+	f := &SmtpFront{smtpConfig: smtpConfig, telegramConfigStore: telegramConfigStore, backendAddr: backendAddr}
+	if smtpConfig.smtpTlsCertFile != "" {
+		certificates, err := NewCertificateReloader(smtpConfig.smtpTlsCertFile, smtpConfig.smtpTlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		f.tlsConfig = &tls.Config{
+			GetCertificate: certificates.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	if smtpConfig.smtpAuthFile != "" {
+		credentials, err := LoadSmtpCredentials(smtpConfig.smtpAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		f.credentials = credentials
+	}
+	return f, nil
+}
+
+// ReserveLoopbackAddress returns a free TCP address on the loopback
+// interface for guerrilla to listen to. guerrilla doesn't accept
+// a listener, so the port is released and taken again by guerrilla.
+// If another process takes the port in between, guerrilla fails
+// to start.
+func ReserveLoopbackAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func (f *SmtpFront) Start() error {
+	l, err := net.Listen("tcp", f.smtpConfig.smtpListen)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %s: %s", f.smtpConfig.smtpListen, err)
+	}
+	f.listeners = append(f.listeners, l)
+	f.serving.Add(1)
+	go f.serve(l, false)
+
+	if f.smtpConfig.smtpTlsListen != "" {
+		l, err := net.Listen("tcp", f.smtpConfig.smtpTlsListen)
+		if err != nil {
+			f.Shutdown()
+			return fmt.Errorf("Unable to listen on %s: %s", f.smtpConfig.smtpTlsListen, err)
+		}
+		f.listeners = append(f.listeners, l)
+		f.serving.Add(1)
+		go f.serve(l, true)
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections. The established sessions
+// end as soon as guerrilla closes their connections.
+func (f *SmtpFront) Shutdown() {
+	for _, l := range f.listeners {
+		l.Close()
+	}
+}
+
+// Serving tells whether all of the listeners accept connections.
+// Unlike a probe connection, it isn't subject to the access list.
+func (f *SmtpFront) Serving() bool {
+	return int(f.serving.Load()) == len(f.listeners)
+}
+
+// Wait blocks until all sessions have ended.
+func (f *SmtpFront) Wait() {
+	f.wg.Wait()
+}
+
+func (f *SmtpFront) serve(l net.Listener, implicitTls bool) {
+	defer f.serving.Add(-1)
+	logger.Infof("Listening on TCP %s (TLS: %t)", l.Addr(), implicitTls)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorf("Unable to accept a connection: %s", err)
+			continue
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			if err := f.handle(conn, implicitTls); err != nil && err != io.EOF {
+				logger.Warnf("[%s] SMTP session error: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (f *SmtpFront) handle(conn net.Conn, implicitTls bool) error {
+	s := &smtpFrontSession{front: f, conn: conn, reader: bufio.NewReader(conn)}
+	s.remoteIP, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	if accessList := f.smtpConfig.smtpAccessList; accessList != nil && !accessList.Allows(s.remoteIP) {
+		logger.Warnf("[%s] Connection refused by the access list", s.remoteIP)
+		commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED).Inc()
+		// The TLS handshake isn't worth it, the connection is just closed.
+		if !implicitTls {
+			s.reply("554 5.7.1 Access denied")
+		}
+		return nil
+	}
+	if implicitTls {
+		if err := s.upgradeToTls(); err != nil {
+			return err
+		}
+	}
+
+	backend, err := net.DialTimeout("tcp", f.backendAddr, smtpFrontTimeout)
+	if err != nil {
+		s.reply("421 4.3.0 Service not available")
+		return err
+	}
+	defer backend.Close()
+	s.backend = backend
+	s.backendReader = bufio.NewReader(backend)
+	return s.run()
+}
+
+type smtpFrontSession struct {
+	front         *SmtpFront
+	conn          net.Conn
+	reader        *bufio.Reader
+	backend       net.Conn
+	backendReader *bufio.Reader
+	remoteIP      string
+	tls           bool
+	// The authenticated user, nil until AUTH succeeds.
+	user *SmtpUser
+}
+
+func (s *smtpFrontSession) run() error {
+	token, err := newSmtpFrontSessionToken()
+	if err != nil {
+		return err
+	}
+	s.front.sessions.Store(token, s)
+	defer s.front.sessions.Delete(token)
+
+	greeting, err := s.readBackendResponse(smtpFrontTimeout)
+	if err != nil {
+		return err
+	}
+	resp, err := s.relayCommand("XCLIENT ADDR=" + token + "\r\n")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "250") {
+		return fmt.Errorf("XCLIENT is refused: %s", strings.TrimSpace(resp))
+	}
+	if err := s.write(greeting); err != nil {
+		return err
+	}
+
+	for {
+		line, err := s.readCommand()
+		if err == errSmtpLineTooLong {
+			s.reply("500 5.5.2 Line too long")
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		verb := strings.ToUpper(strings.TrimSpace(strings.SplitN(line, " ", 2)[0]))
+		var rcpt mail.Address
+		var rcptErr error
+		if verb == "RCPT" {
+			rcpt, rcptErr = ParseSmtpPath(line)
+		}
+		switch {
+		case verb == "STARTTLS" && s.front.tlsConfig != nil && !s.tls:
+			if err := s.reply("220 2.0.0 Ready to start TLS"); err != nil {
+				return err
+			}
+			if err := s.upgradeToTls(); err != nil {
+				return err
+			}
+			// The client starts over, so should guerrilla.
+			s.user = nil
+			if _, err := s.relayCommand("RSET\r\n"); err != nil {
+				return err
+			}
+			continue
+		case smtpTransactionCommands[verb] && s.front.smtpConfig.smtpRequireTls && !s.tls:
+			commandsRejected.WithLabelValues(REJECT_REASON_TLS_REQUIRED).Inc()
+			err = s.reply("530 5.7.0 Must issue a STARTTLS command first")
+		case smtpTransactionCommands[verb] && s.front.credentials != nil && s.user == nil:
+			commandsRejected.WithLabelValues(REJECT_REASON_AUTH_REQUIRED).Inc()
+			err = s.reply("530 5.7.0 Authentication required")
+		case verb == "RCPT" && rcptErr != nil:
+			err = s.reply("501 5.1.3 Invalid address")
+		case verb == "RCPT" && !s.acceptsRecipient(rcpt.String()):
+			logger.Warnf("[%s] Relay to %s denied", s.remoteIP, rcpt.String())
+			commandsRejected.WithLabelValues(REJECT_REASON_RELAY_DENIED).Inc()
+			err = s.reply("550 5.7.1 Relay access denied")
+		case verb == "RCPT" && s.user != nil &&
+			!s.user.AllowsRoute(MatchRoute(rcpt, s.front.telegramConfigStore.Load())):
+			logger.Warnf("[%s] User %q is not allowed to send to %s", s.remoteIP, s.user.name, rcpt.String())
+			commandsRejected.WithLabelValues(REJECT_REASON_RECIPIENT_NOT_ALLOWED).Inc()
+			err = s.reply("550 5.7.1 Recipient not allowed")
+		case verb == "XCLIENT":
+			// Only the front can tell guerrilla the client's address.
+			err = s.reply("502 5.5.1 Command not implemented")
+		case verb == "AUTH" && s.front.credentials != nil:
+			err = s.authenticate(strings.Fields(line)[1:])
+		case verb == "EHLO":
+			err = s.relayEhlo(line)
+		case verb == "DATA":
+			err = s.relayData(line)
+		default:
+			err = s.relay(line)
+		}
+		if err != nil {
+			return err
+		}
+		if verb == "QUIT" {
+			return nil
+		}
+	}
+}
+
+func newSmtpFrontSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ProcessorFactory makes the `SmtpFront` guerrilla processor, which
+// refuses the emails of the sessions not relayed by the front and
+// replaces the session token with the client's address for
+// the following processors.
+func (f *SmtpFront) ProcessorFactory() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				token := e.RemoteIP
+				session, ok := f.sessions.Load(token)
+				if !ok {
+					logger.Warnf("[%q] Refusing a session which bypasses the SMTP front", token)
+					commandsRejected.WithLabelValues(REJECT_REASON_ACCESS_DENIED).Inc()
+					err := errors.New("Access denied")
+					return backends.NewResult(fmt.Sprintf("554 5.7.1 %s", err)), err
+				}
+				e.RemoteIP = session.(*smtpFrontSession).remoteIP
+				defer func() { e.RemoteIP = token }()
+				return p.Process(e, task)
+			},
+		)
+	}
+}
+
+func (s *smtpFrontSession) upgradeToTls() error {
+	tlsConn := tls.Server(s.conn, s.front.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(smtpFrontTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	s.conn = tlsConn
+	// Anything sent before the handshake must be discarded.
+	s.reader = bufio.NewReader(tlsConn)
+	s.tls = true
+	return nil
+}
+
+// relayEhlo relays EHLO and advertises the extensions of the front.
+func (s *smtpFrontSession) relayEhlo(line string) error {
+	resp, err := s.relayCommand(line)
+	if err != nil {
+		return err
+	}
+	extensions := []string{}
+	if s.front.tlsConfig != nil && !s.tls {
+		extensions = append(extensions, "STARTTLS")
+	}
+	if s.front.credentials != nil && s.authAllowed() {
+		extensions = append(extensions, "AUTH PLAIN LOGIN")
+	}
+	if len(extensions) > 0 && strings.HasPrefix(resp, "250") {
+		// Insert the extensions before the last line.
+		lines := strings.SplitAfter(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+		last := lines[len(lines)-1]
+		var b strings.Builder
+		for _, l := range lines[:len(lines)-1] {
+			b.WriteString(l)
+		}
+		for _, extension := range extensions {
+			b.WriteString("250-" + extension + "\r\n")
+		}
+		b.WriteString(last + "\r\n")
+		resp = b.String()
+	}
+	return s.write(resp)
+}
+
+func (s *smtpFrontSession) acceptsRecipient(address string) bool {
+	accepted := s.front.smtpConfig.smtpAcceptedRecipients
+	return accepted == nil || accepted.Matches(address)
+}
+
+// authAllowed tells whether the credentials can be sent over the
+// connection: when TLS is available it must be started first.
+func (s *smtpFrontSession) authAllowed() bool {
+	return s.front.tlsConfig == nil || s.tls
+}
+
+// authenticate handles AUTH PLAIN and AUTH LOGIN (RFC 4954).
+func (s *smtpFrontSession) authenticate(args []string) error {
+	if !s.authAllowed() {
+		return s.reply("538 5.7.11 Encryption required for requested authentication mechanism")
+	}
+	if s.user != nil {
+		return s.reply("503 5.5.1 Already authenticated")
+	}
+	if len(args) == 0 {
+		return s.reply("501 5.5.4 Syntax error in parameters")
+	}
+	var username, password string
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		resp, err := s.authResponse(args[1:], "")
+		if err != nil {
+			return s.replyAuthError(err)
+		}
+		// authzid NUL authcid NUL passwd
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			return s.reply("501 5.5.2 Invalid PLAIN response")
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		var err error
+		if username, err = s.authResponse(args[1:], "Username:"); err != nil {
+			return s.replyAuthError(err)
+		}
+		if password, err = s.authResponse(nil, "Password:"); err != nil {
+			return s.replyAuthError(err)
+		}
+	default:
+		return s.reply("504 5.5.4 Unrecognized authentication type")
+	}
+
+	user := s.front.credentials.Authenticate(username, password)
+	if user == nil {
+		logger.Warnf("[%s] SMTP authentication failed for %q", s.remoteIP, username)
+		commandsRejected.WithLabelValues(REJECT_REASON_AUTH_FAILED).Inc()
+		return s.reply("535 5.7.8 Authentication credentials invalid")
+	}
+	logger.Infof("[%s] SMTP authenticated as %q", s.remoteIP, username)
+	s.user = user
+	return s.reply("235 2.7.0 Authentication successful")
+}
+
+// authResponse returns the decoded initial response if it has been
+// sent along with AUTH, otherwise it sends the challenge and reads
+// the response.
+func (s *smtpFrontSession) authResponse(initial []string, challenge string) (string, error) {
+	var resp string
+	if len(initial) > 0 {
+		resp = initial[0]
+	} else {
+		if err := s.reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge))); err != nil {
+			return "", err
+		}
+		line, err := s.readCommand()
+		if err != nil {
+			return "", err
+		}
+		resp = strings.TrimSpace(line)
+	}
+	if resp == "*" {
+		return "", errSmtpAuthCancelled
+	}
+	if resp == "=" {
+		// An empty initial response.
+		return "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return "", errSmtpAuthSyntax
+	}
+	return string(decoded), nil
+}
+
+func (s *smtpFrontSession) replyAuthError(err error) error {
+	switch err {
+	case errSmtpAuthCancelled:
+		return s.reply("501 5.7.0 Authentication cancelled")
+	case errSmtpAuthSyntax:
+		return s.reply("501 5.5.2 Cannot decode response")
+	}
+	return err
+}
+
+// ParseSmtpPath parses the address of a MAIL FROM or RCPT TO command
+// with the parser of guerrilla, so that the front checks the same
+// address guerrilla receives.
+func ParseSmtpPath(line string) (mail.Address, error) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return mail.Address{}, errors.New("no path")
+	}
+	verb := strings.ToUpper(strings.TrimSpace(strings.SplitN(line, " ", 2)[0]))
+	input := []byte(strings.TrimSpace(line[i+1:]))
+	if len(input) > rfc5321.LimitPath {
+		return mail.Address{}, errors.New("path too long")
+	}
+	var parser rfc5321.Parser
+	var err error
+	if verb == "MAIL" {
+		err = parser.MailFrom(input)
+	} else {
+		err = parser.RcptTo(input)
+	}
+	if err != nil {
+		return mail.Address{}, err
+	}
+	return mail.Address{
+		User:     parser.LocalPart,
+		Host:     parser.Domain,
+		Quoted:   parser.LocalPartQuotes,
+		IP:       parser.IP,
+		NullPath: parser.NullPath,
+	}, nil
+}
+
+// relayData relays DATA followed by the message up to the
+// terminating dot line.
+func (s *smtpFrontSession) relayData(line string) error {
+	resp, err := s.relayCommand(line)
+	if err != nil {
+		return err
+	}
+	if err := s.write(resp); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "354") {
+		return nil
+	}
+	atLineStart := true
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(smtpFrontTimeout))
+		chunk, err := s.reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+		s.backend.SetWriteDeadline(time.Now().Add(smtpFrontTimeout))
+		if _, err := s.backend.Write(chunk); err != nil {
+			return err
+		}
+		if err == bufio.ErrBufferFull {
+			atLineStart = false
+			continue
+		}
+		if atLineStart && (bytes.Equal(chunk, []byte(".\r\n")) || bytes.Equal(chunk, []byte(".\n"))) {
+			break
+		}
+		atLineStart = true
+	}
+	// guerrilla delivers the email before replying, which takes up to
+	// its save timeout. Giving up earlier makes the client retry the
+	// email which might be delivered still.
+	resp, err = s.readBackendResponse(smtpSaveTimeout + smtpFrontTimeout)
+	if err != nil {
+		return err
+	}
+	return s.write(resp)
+}
+
+func (s *smtpFrontSession) relay(line string) error {
+	resp, err := s.relayCommand(line)
+	if err != nil {
+		return err
+	}
+	return s.write(resp)
+}
+
+// relayCommand sends the command to guerrilla and returns its response.
+func (s *smtpFrontSession) relayCommand(line string) (string, error) {
+	s.backend.SetWriteDeadline(time.Now().Add(smtpFrontTimeout))
+	if _, err := io.WriteString(s.backend, line); err != nil {
+		return "", err
+	}
+	return s.readBackendResponse(smtpFrontTimeout)
+}
+
+// readBackendResponse reads a possibly multi-line response of guerrilla.
+func (s *smtpFrontSession) readBackendResponse(timeout time.Duration) (string, error) {
+	var b strings.Builder
+	for {
+		s.backend.SetReadDeadline(time.Now().Add(timeout))
+		line, err := s.backendReader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(line)
+		// The last line of a response has a space after the code.
+		if len(line) < 4 || line[3] != '-' {
+			return b.String(), nil
+		}
+	}
+}
+
+func (s *smtpFrontSession) readCommand() (string, error) {
+	var b []byte
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(smtpFrontTimeout))
+		chunk, err := s.reader.ReadSlice('\n')
+		b = append(b, chunk...)
+		if len(b) > smtpFrontMaxCommandLength {
+			return "", errSmtpLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+func (s *smtpFrontSession) reply(resp string) error {
+	return s.write(resp + "\r\n")
+}
+
+func (s *smtpFrontSession) write(resp string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(smtpFrontTimeout))
+	_, err := io.WriteString(s.conn, resp)
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSmtpTlsListen = "127.0.0.1:22726"
+
+// writeTestCertificate writes a self-signed certificate to the dir.
+func writeTestCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func makeTlsSmtpConfig(t *testing.T) *SmtpConfig {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpTlsCertFile, smtpConfig.smtpTlsKeyFile = writeTestCertificate(t, t.TempDir(), "testhost")
+	return smtpConfig
+}
+
+func sendMailWithClient(c *smtp.Client, from string, to string, body string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestStartTls(t *testing.T) {
+	smtpConfig := makeTlsSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client"))
+	ok, _ := c.Extension("STARTTLS")
+	assert.True(t, ok)
+	require.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	ok, _ = c.Extension("STARTTLS")
+	assert.False(t, ok)
+
+	assert.NoError(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 2)
+	assert.Equal(t, "From: from@test\nTo: to@test\nSubject: \n\nhi", h.RequestMessages[0])
+}
+
+func TestRequireTls(t *testing.T) {
+	smtpConfig := makeTlsSmtpConfig(t)
+	smtpConfig.smtpRequireTls = true
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	err = c.Mail("from@test")
+	if assert.Error(t, err) {
+		assert.Equal(t, 530, err.(*textproto.Error).Code)
+	}
+
+	require.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	assert.NoError(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+func TestImplicitTls(t *testing.T) {
+	smtpConfig := makeTlsSmtpConfig(t)
+	smtpConfig.smtpTlsListen = testSmtpTlsListen
+	smtpConfig.smtpRequireTls = true
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", testSmtpTlsListen, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	c, err := smtp.NewClient(conn, "testhost")
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client"))
+	ok, _ := c.Extension("STARTTLS")
+	assert.False(t, ok)
+
+	assert.NoError(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpTlsCertFile, smtpConfig.smtpTlsKeyFile = writeTestCertificate(t, dir, "first")
+	smtpConfig.smtpTlsListen = testSmtpTlsListen
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	peerCommonName := func() string {
+		conn, err := tls.Dial("tcp", testSmtpTlsListen, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", peerCommonName())
+
+	writeTestCertificate(t, dir, "second")
+	// Make sure the mtime changes regardless of the fs precision.
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(smtpConfig.smtpTlsCertFile, future, future))
+	require.NoError(t, os.Chtimes(smtpConfig.smtpTlsKeyFile, future, future))
+	waitFor(t, func() bool { return peerCommonName() == "second" })
+}
+
+func TestSmtpFrontRefusesXClient(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("127.0.0.0/8,::1", "")
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "{sender_ip} {helo}"
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	c, err := smtp.Dial(smtpConfig.smtpListen)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client"))
+	id, err := c.Text.Cmd("XCLIENT ADDR=10.1.2.3 HELO=spoofed")
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	assert.Equal(t, 502, smtpErrorCode(err))
+
+	assert.NoError(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Equal(t, []string{"127.0.0.1 client", "127.0.0.1 client"}, h.RequestMessages)
+}
+
+func TestSmtpFrontBackendRefusesDirectSessions(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.smtpAccessList, _ = NewIpAccessList("10.0.0.0/8", "")
+	telegramConfig := makeTelegramConfig()
+	d, err := SmtpStart(smtpConfig, telegramConfig)
+	require.NoError(t, err)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	// A local process connecting to guerrilla behind the front.
+	c, err := smtp.Dial(d.front.backendAddr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client"))
+	id, err := c.Text.Cmd("XCLIENT ADDR=10.1.2.3")
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	require.NoError(t, err)
+
+	assert.Error(t, sendMailWithClient(c, "from@test", "to@test", "hi"))
+	assert.Len(t, h.RequestMessages, 0)
+}
+
+func TestParseSmtpPath(t *testing.T) {
+	address, err := ParseSmtpPath(`RCPT TO:<"x@alerts.local>"@evil.com>`)
+	require.NoError(t, err)
+	assert.Equal(t, "x@alerts.local>", address.User)
+	assert.Equal(t, "evil.com", address.Host)
+	assert.Equal(t, `"x@alerts.local>"@evil.com`, address.String())
+
+	address, err = ParseSmtpPath("MAIL FROM:<> SIZE=10")
+	require.NoError(t, err)
+	assert.True(t, address.NullPath)
+
+	_, err = ParseSmtpPath("RCPT TO:<ops@alerts.local")
+	assert.Error(t, err)
+}
@@ -13,7 +13,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,23 +38,60 @@ const (
 	BodyTruncated = "\n\n[truncated]"
 )
 
+// guerrilla replies to the end of DATA once the email is saved,
+// so it needs to be greater than ST_TELEGRAM_API_TIMEOUT_SECONDS.
+const smtpSaveTimeout = 600 * time.Second
+
 type SmtpConfig struct {
-	smtpListen          string
-	smtpPrimaryHost     string
-	smtpMaxEnvelopeSize int64
-	logLevel            string
+	smtpListen             string
+	smtpPrimaryHost        string
+	smtpMaxEnvelopeSize    int64
+	logLevel               string
+	spoolDir               string
+	spoolMaxAge            time.Duration
+	spoolRetryMinDelay     time.Duration
+	spoolRetryMaxDelay     time.Duration
+	smtpTlsListen          string
+	smtpTlsCertFile        string
+	smtpTlsKeyFile         string
+	smtpRequireTls         bool
+	smtpAuthFile           string
+	smtpAccessList         *IpAccessList
+	smtpAcceptedRecipients AddressPatterns
+	httpListen             string
+	healthCheckInterval    time.Duration
+	healthCheckMaxAge      time.Duration
 }
 
 type TelegramConfig struct {
-	telegramChatIds                  string
-	telegramBotToken                 string
-	telegramApiPrefix                string
-	telegramApiTimeoutSeconds        float64
-	messageTemplate                  string
-	forwardedAttachmentMaxSize       int
-	forwardedAttachmentMaxPhotoSize  int
-	forwardedAttachmentRespectErrors bool
-	messageLengthToSendAsFile        uint
+	telegramChatIds                      string
+	telegramBotToken                     string
+	telegramApiPrefix                    string
+	telegramApiTimeoutSeconds            float64
+	messageTemplate                      string
+	messageTemplateEngine                string
+	messageParseMode                     string
+	messageDateFormat                    string
+	messageDateLocation                  *time.Location
+	forwardedAttachmentMaxSize           int
+	forwardedAttachmentMaxPhotoSize      int
+	forwardedAttachmentMaxAnimationSize  int
+	forwardedAttachmentMaxVideoSize      int
+	forwardedAttachmentMaxAudioSize      int
+	forwardedAttachmentMaxVoiceSize      int
+	forwardedAttachmentPhotoMaxDimension int
+	forwardedAttachmentPhotoQuality      int
+	forwardedAttachmentPhotoSendOriginal bool
+	forwardedAttachmentRespectErrors     bool
+	messageLengthToSendAsFile            uint
+	longMessageMode                      string
+	telegramRateLimitPerChat             float64
+	telegramRateLimitGlobal              float64
+	telegramFloodMaxWait                 time.Duration
+	telegramRoutes                       []*TelegramRoute
+	telegramRules                        []*TelegramRule
+	telegramStartupCheck                 string
+	rateLimiter                          *TelegramRateLimiter
 }
 
 type TelegramAPIMessageResult struct {
@@ -62,18 +102,110 @@ type TelegramAPIMessageResult struct {
 type TelegramAPIMessage struct {
 	// https://core.telegram.org/bots/api#message
 	MessageId json.Number `json:"message_id"`
+	// The sizes of the photo, the largest last.
+	Photo     []TelegramAPIFile `json:"photo"`
+	Document  *TelegramAPIFile  `json:"document"`
+	Animation *TelegramAPIFile  `json:"animation"`
+	Video     *TelegramAPIFile  `json:"video"`
+	Audio     *TelegramAPIFile  `json:"audio"`
+	Voice     *TelegramAPIFile  `json:"voice"`
+}
+
+type TelegramAPIFile struct {
+	// https://core.telegram.org/bots/api#document
+	// https://core.telegram.org/bots/api#photosize
+	// https://core.telegram.org/bots/api#animation
+	// https://core.telegram.org/bots/api#video
+	// https://core.telegram.org/bots/api#audio
+	// https://core.telegram.org/bots/api#voice
+	FileId string `json:"file_id"`
+}
+
+type TelegramAPIUserResult struct {
+	Ok     bool             `json:"ok"`
+	Result *TelegramAPIUser `json:"result"`
+}
+
+type TelegramAPIUser struct {
+	// https://core.telegram.org/bots/api#user
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type TelegramAPIChatResult struct {
+	Ok     bool             `json:"ok"`
+	Result *TelegramAPIChat `json:"result"`
+}
+
+type TelegramAPIChat struct {
+	// https://core.telegram.org/bots/api#chat
+	Id    int64  `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+}
+
+type TelegramAPIErrorResult struct {
+	Ok          bool                           `json:"ok"`
+	ErrorCode   int                            `json:"error_code"`
+	Description string                         `json:"description"`
+	Parameters  *TelegramAPIResponseParameters `json:"parameters"`
+}
+
+type TelegramAPIResponseParameters struct {
+	// https://core.telegram.org/bots/api#responseparameters
+	RetryAfter int `json:"retry_after"`
 }
 
 type FormattedEmail struct {
-	text        string
+	text string
+	// The rest of a long message split into parts,
+	// sent as the replies to the text.
+	replies     []string
 	attachments []*FormattedAttachment
+	silent      bool
+	// Forbid forwarding and saving the message and its attachments.
+	protectContent bool
+	// The number of the parts which are not forwarded.
+	discardedAttachments int
+	// The parsed email, used for matching the rules.
+	env  *enmime.Envelope
+	body string
 }
 
 const (
-	ATTACHMENT_TYPE_DOCUMENT = iota
-	ATTACHMENT_TYPE_PHOTO    = iota
+	ATTACHMENT_TYPE_DOCUMENT  = iota
+	ATTACHMENT_TYPE_PHOTO     = iota
+	ATTACHMENT_TYPE_ANIMATION = iota
+	ATTACHMENT_TYPE_VIDEO     = iota
+	ATTACHMENT_TYPE_AUDIO     = iota
+	ATTACHMENT_TYPE_VOICE     = iota
 )
 
+type AttachmentTypeMethod struct {
+	// https://core.telegram.org/bots/api#sending-files
+	method string
+	// The field of the file, also the type of its InputMedia.
+	field string
+	// The attachments of the same media group kind can be sent
+	// together in a media group, empty if they can't be grouped.
+	mediaGroupKind string
+}
+
+var attachmentTypeMethods = map[int]AttachmentTypeMethod{
+	// https://core.telegram.org/bots/api#senddocument
+	ATTACHMENT_TYPE_DOCUMENT: {"sendDocument", "document", "document"},
+	// https://core.telegram.org/bots/api#sendphoto
+	ATTACHMENT_TYPE_PHOTO: {"sendPhoto", "photo", "visual"},
+	// https://core.telegram.org/bots/api#sendanimation
+	ATTACHMENT_TYPE_ANIMATION: {"sendAnimation", "animation", ""},
+	// https://core.telegram.org/bots/api#sendvideo
+	ATTACHMENT_TYPE_VIDEO: {"sendVideo", "video", "visual"},
+	// https://core.telegram.org/bots/api#sendaudio
+	ATTACHMENT_TYPE_AUDIO: {"sendAudio", "audio", "audio"},
+	// https://core.telegram.org/bots/api#sendvoice
+	ATTACHMENT_TYPE_VOICE: {"sendVoice", "voice", ""},
+}
+
 type FormattedAttachment struct {
 	filename string
 	caption  string
@@ -90,52 +222,67 @@ func GetHostname() string {
 }
 
 func main() {
+	app := NewApp()
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func NewApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "smtp_to_telegram"
 	app.Usage = "A simple program that listens for SMTP and forwards " +
 		"all incoming Email messages to Telegram."
 	app.Version = Version
 	app.Action = func(c *cli.Context) error {
-		smtpMaxEnvelopeSize, err := units.FromHumanSize(c.String("smtp-max-envelope-size"))
+		smtpConfig, telegramConfig, err := LoadConfig(c)
 		if err != nil {
 			fmt.Printf("%s\n", err)
 			os.Exit(1)
 		}
-		smtpConfig := &SmtpConfig{
-			smtpListen:          c.String("smtp-listen"),
-			smtpPrimaryHost:     c.String("smtp-primary-host"),
-			smtpMaxEnvelopeSize: smtpMaxEnvelopeSize,
-			logLevel:            c.String("log-level"),
-		}
-		forwardedAttachmentMaxSize, err := units.FromHumanSize(c.String("forwarded-attachment-max-size"))
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			os.Exit(1)
-		}
-		forwardedAttachmentMaxPhotoSize, err := units.FromHumanSize(c.String("forwarded-attachment-max-photo-size"))
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			os.Exit(1)
+		if telegramConfig.telegramStartupCheck == STARTUP_CHECK_FAIL {
+			// The check runs before SmtpStart, which would set these up,
+			// and calling Telegram needs both.
+			if logger, err = log.GetLogger(log.OutputStdout.String(), smtpConfig.logLevel); err != nil {
+				fmt.Printf("%s\n", err)
+				os.Exit(1)
+			}
+			telegramConfig.rateLimiter = NewTelegramRateLimiter(
+				telegramConfig.telegramRateLimitPerChat,
+				telegramConfig.telegramRateLimitGlobal,
+			)
+			if err := CheckTelegramConfig(telegramConfig); err != nil {
+				fmt.Printf("%s\n", err)
+				os.Exit(1)
+			}
 		}
-		telegramConfig := &TelegramConfig{
-			telegramChatIds:                  c.String("telegram-chat-ids"),
-			telegramBotToken:                 c.String("telegram-bot-token"),
-			telegramApiPrefix:                c.String("telegram-api-prefix"),
-			telegramApiTimeoutSeconds:        c.Float64("telegram-api-timeout-seconds"),
-			messageTemplate:                  c.String("message-template"),
-			forwardedAttachmentMaxSize:       int(forwardedAttachmentMaxSize),
-			forwardedAttachmentMaxPhotoSize:  int(forwardedAttachmentMaxPhotoSize),
-			forwardedAttachmentRespectErrors: c.Bool("forwarded-attachment-respect-errors"),
-			messageLengthToSendAsFile:        c.Uint("message-length-to-send-as-file"),
-		}
-		d, err := SmtpStart(smtpConfig, telegramConfig)
+		server, err := SmtpStart(smtpConfig, telegramConfig)
 		if err != nil {
 			panic(fmt.Sprintf("start error: %s", err))
 		}
-		sigHandler(d)
+		if telegramConfig.telegramStartupCheck == STARTUP_CHECK_WARN {
+			// Don't delay the start when Telegram is slow to respond.
+			go func() {
+				if err := CheckTelegramConfig(telegramConfig); err != nil {
+					logger.Warn(err.Error())
+				} else {
+					logger.Info("Telegram startup check passed")
+				}
+			}()
+		}
+		sigHandler(server, c)
 		return nil
 	}
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name: "config",
+			Usage: "Path to a YAML config file. Its keys are the names of these flags, " +
+				"plus the routes and rules sections. The flags and the env vars " +
+				"take precedence over the file.",
+			EnvVars: []string{"ST_CONFIG"},
+		},
 		&cli.StringFlag{
 			Name:    "smtp-listen",
 			Value:   "127.0.0.1:2525",
@@ -155,16 +302,110 @@ func main() {
 			EnvVars: []string{"ST_SMTP_MAX_ENVELOPE_SIZE"},
 		},
 		&cli.StringFlag{
-			Name:     "telegram-chat-ids",
-			Usage:    "Telegram: comma-separated list of chat ids",
-			EnvVars:  []string{"ST_TELEGRAM_CHAT_IDS"},
-			Required: true,
+			Name: "smtp-tls-cert-file",
+			Usage: "SMTP: path to a PEM certificate chain. When set, STARTTLS is offered. " +
+				"The certificate is reloaded when the file changes.",
+			EnvVars: []string{"ST_SMTP_TLS_CERT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "smtp-tls-key-file",
+			Usage:   "SMTP: path to a PEM private key of the certificate",
+			EnvVars: []string{"ST_SMTP_TLS_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name: "smtp-tls-listen",
+			Usage: "SMTP: TCP address to listen to with implicit TLS (SMTPS), " +
+				"e.g. 0.0.0.0:465. Empty -- disabled.",
+			EnvVars: []string{"ST_SMTP_TLS_LISTEN"},
+		},
+		&cli.BoolFlag{
+			Name:    "smtp-require-tls",
+			Usage:   "SMTP: reject MAIL FROM with 530 until the client has started TLS",
+			Value:   false,
+			EnvVars: []string{"ST_SMTP_REQUIRE_TLS"},
+		},
+		&cli.StringFlag{
+			Name: "smtp-auth-file",
+			Usage: "SMTP: path to an htpasswd-style file of the users allowed to send emails " +
+				"(user:bcrypt hash, optionally followed by :allowed route patterns). " +
+				"When set, AUTH PLAIN/LOGIN is required. The file is reloaded when it changes.",
+			EnvVars: []string{"ST_SMTP_AUTH_FILE"},
+		},
+		&cli.StringFlag{
+			Name: "smtp-allowed-networks",
+			Usage: "SMTP: comma-separated list of networks (CIDR, IPv4 or IPv6) allowed to connect. " +
+				"Example: 10.0.0.0/8,fd00::/8. Empty -- everyone who isn't denied.",
+			EnvVars: []string{"ST_SMTP_ALLOWED_NETWORKS"},
+		},
+		&cli.StringFlag{
+			Name: "smtp-denied-networks",
+			Usage: "SMTP: comma-separated list of networks (CIDR, IPv4 or IPv6) refused with 554 on connect. " +
+				"Takes precedence over smtp-allowed-networks.",
+			EnvVars: []string{"ST_SMTP_DENIED_NETWORKS"},
+		},
+		&cli.StringFlag{
+			Name: "smtp-accepted-recipients",
+			Usage: "SMTP: comma-separated list of the recipient domains and addresses to accept mail for, " +
+				"the rest are refused with 550 at RCPT TO. " +
+				"Example: alerts.local,*.example.com,ops@billing.local. Empty -- any recipient.",
+			EnvVars: []string{"ST_SMTP_ACCEPTED_RECIPIENTS"},
+		},
+		&cli.StringFlag{
+			Name: "http-listen",
+			Usage: "TCP address to listen to for the Prometheus metrics at /metrics " +
+				"and the probes at /healthz and /readyz. Empty -- disabled.",
+			EnvVars: []string{"ST_HTTP_LISTEN"},
+		},
+		&cli.DurationFlag{
+			Name: "health-check-interval",
+			Usage: "Interval of the getMe calls checking that the Telegram API is reachable " +
+				"and the bot token is valid. 0 -- /readyz doesn't check Telegram.",
+			Value:   30 * time.Second,
+			EnvVars: []string{"ST_HEALTH_CHECK_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "health-check-max-age",
+			Usage:   "/readyz fails when the last successful getMe is older than this",
+			Value:   2 * time.Minute,
+			EnvVars: []string{"ST_HEALTH_CHECK_MAX_AGE"},
+		},
+		&cli.StringFlag{
+			Name: "telegram-chat-ids",
+			Usage: "Telegram: comma-separated list of chat ids. " +
+				"A forum topic of a supergroup is set as chatid:threadid. " +
+				"The default route when telegram-routes are set.",
+			EnvVars: []string{"ST_TELEGRAM_CHAT_IDS"},
+		},
+		&cli.StringFlag{
+			Name: "telegram-routes",
+			Usage: "Telegram: routes of the recipient addresses to chat ids, " +
+				"the first matching route wins. " +
+				"Example: ops@alerts.local=-1001,-1002:7;@billing.local=42;/^db-.*@alerts\\.local$/=43. " +
+				"Emails to the recipients matching no route are sent to telegram-chat-ids, " +
+				"or rejected if that's empty.",
+			EnvVars: []string{"ST_TELEGRAM_ROUTES"},
 		},
 		&cli.StringFlag{
-			Name:     "telegram-bot-token",
-			Usage:    "Telegram: bot token",
-			EnvVars:  []string{"ST_TELEGRAM_BOT_TOKEN"},
-			Required: true,
+			Name:    "telegram-bot-token",
+			Usage:   "Telegram: bot token",
+			EnvVars: []string{"ST_TELEGRAM_BOT_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name: "telegram-rules",
+			Usage: "Telegram: JSON list of rules applied to every email, the first matching rule wins. " +
+				"A rule matches when all of its regexps match: " +
+				"from (the envelope sender), subject, headers (an object of header name to regexp), body. " +
+				"action is one of deliver (default), drop or reject. " +
+				"The delivered emails can be altered with chat_ids, template, silent and protect_content. " +
+				"Example: [{\"from\":\"^cron@\",\"subject\":\"success\",\"action\":\"drop\"}]",
+			EnvVars: []string{"ST_TELEGRAM_RULES"},
+		},
+		&cli.StringFlag{
+			Name: "telegram-startup-check",
+			Usage: "Telegram: on start, check the bot token with getMe and each configured chat id " +
+				"with getChat. One of: fail (exit on errors), warn (log the errors), off.",
+			Value:   STARTUP_CHECK_WARN,
+			EnvVars: []string{"ST_TELEGRAM_STARTUP_CHECK"},
 		},
 		&cli.StringFlag{
 			Name:    "telegram-api-prefix",
@@ -173,17 +414,66 @@ func main() {
 			EnvVars: []string{"ST_TELEGRAM_API_PREFIX"},
 		},
 		&cli.StringFlag{
-			Name:    "message-template",
-			Usage:   "Telegram message template",
+			Name: "message-template",
+			Usage: "Telegram message template. The placeholders are {from}, {to}, {subject}, {body}, " +
+				"{attachments_details}, {date}, {sender_ip}, {helo} and {header:Name}.",
 			Value:   "From: {from}\\nTo: {to}\\nSubject: {subject}\\n\\n{body}\\n\\n{attachments_details}",
 			EnvVars: []string{"ST_TELEGRAM_MESSAGE_TEMPLATE"},
 		},
+		&cli.StringFlag{
+			Name:    "message-date-format",
+			Usage:   "Telegram message: Go layout of the {date} placeholder, see https://pkg.go.dev/time#Layout",
+			Value:   time.RFC1123Z,
+			EnvVars: []string{"ST_TELEGRAM_MESSAGE_DATE_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name: "message-date-timezone",
+			Usage: "Telegram message: IANA time zone of the {date} placeholder, e.g. Europe/Berlin or UTC. " +
+				"Empty -- the time zone of the email.",
+			EnvVars: []string{"ST_TELEGRAM_MESSAGE_DATE_TIMEZONE"},
+		},
+		&cli.StringFlag{
+			Name: "message-template-engine",
+			Usage: "Telegram message template engine: placeholders ({from}, {to}, {subject}, " +
+				"{body}, {attachments_details}) or go (text/template with the escape, truncate " +
+				"and replace functions, see README).",
+			Value:   TEMPLATE_ENGINE_PLACEHOLDERS,
+			EnvVars: []string{"ST_TELEGRAM_MESSAGE_TEMPLATE_ENGINE"},
+		},
+		&cli.StringFlag{
+			Name: "message-parse-mode",
+			Usage: "Telegram message parse mode: HTML or MarkdownV2. Empty -- plain text. " +
+				"The values substituted into the template are escaped, " +
+				"the markup of the template itself must be valid for the mode.",
+			EnvVars: []string{"ST_TELEGRAM_MESSAGE_PARSE_MODE"},
+		},
 		&cli.Float64Flag{
 			Name:    "telegram-api-timeout-seconds",
 			Usage:   "HTTP timeout used for requests to the Telegram API",
 			Value:   30,
 			EnvVars: []string{"ST_TELEGRAM_API_TIMEOUT_SECONDS"},
 		},
+		&cli.Float64Flag{
+			Name: "telegram-rate-limit-per-chat",
+			Usage: "Max number of requests per second to the Telegram API " +
+				"for a single chat. 0 -- unlimited.",
+			Value:   1,
+			EnvVars: []string{"ST_TELEGRAM_RATE_LIMIT_PER_CHAT"},
+		},
+		&cli.Float64Flag{
+			Name: "telegram-rate-limit-global",
+			Usage: "Max number of requests per second to the Telegram API " +
+				"for all chats. 0 -- unlimited.",
+			Value:   30,
+			EnvVars: []string{"ST_TELEGRAM_RATE_LIMIT_GLOBAL"},
+		},
+		&cli.DurationFlag{
+			Name: "telegram-flood-max-wait",
+			Usage: "Max total time to wait for retry_after when the Telegram API " +
+				"responds with 429 Too Many Requests. 0 -- don't retry.",
+			Value:   time.Minute,
+			EnvVars: []string{"ST_TELEGRAM_FLOOD_MAX_WAIT"},
+		},
 		&cli.StringFlag{
 			Name: "forwarded-attachment-max-size",
 			Usage: "Max size of an attachment to be forwarded to telegram. " +
@@ -200,6 +490,64 @@ func main() {
 			Value:   "10m",
 			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_MAX_PHOTO_SIZE"},
 		},
+		&cli.StringFlag{
+			Name: "forwarded-attachment-max-animation-size",
+			Usage: "Max size of an animation (GIF) attachment to be forwarded to telegram " +
+				"as a playable media, the larger ones are sent as documents. " +
+				"0 -- send as documents. Examples: 5k, 10m. " +
+				"Telegram API has a 50m limit on their side.",
+			Value:   "10m",
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_MAX_ANIMATION_SIZE"},
+		},
+		&cli.StringFlag{
+			Name: "forwarded-attachment-max-video-size",
+			Usage: "Max size of a video (MP4) attachment to be forwarded to telegram " +
+				"as a playable media, the larger ones are sent as documents. " +
+				"0 -- send as documents. Examples: 5k, 10m. " +
+				"Telegram API has a 50m limit on their side.",
+			Value:   "10m",
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_MAX_VIDEO_SIZE"},
+		},
+		&cli.StringFlag{
+			Name: "forwarded-attachment-max-audio-size",
+			Usage: "Max size of an audio (MP3, M4A) attachment to be forwarded to telegram " +
+				"as a playable media, the larger ones are sent as documents. " +
+				"0 -- send as documents. Examples: 5k, 10m. " +
+				"Telegram API has a 50m limit on their side.",
+			Value:   "10m",
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_MAX_AUDIO_SIZE"},
+		},
+		&cli.StringFlag{
+			Name: "forwarded-attachment-max-voice-size",
+			Usage: "Max size of a voice (OGG of Opus) attachment to be forwarded to telegram " +
+				"as a playable media, the larger ones are sent as documents. " +
+				"0 -- send as documents. Examples: 5k, 10m. " +
+				"Telegram API has a 50m limit on their side.",
+			Value:   "10m",
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_MAX_VOICE_SIZE"},
+		},
+		&cli.UintFlag{
+			Name: "forwarded-attachment-photo-max-dimension",
+			Usage: "Downscale the JPEG and PNG photos wider or higher than this " +
+				"or larger than `forwarded-attachment-max-photo-size`, so that " +
+				"they are sent as photos. 0 -- don't downscale, otherwise from " +
+				"256 to 5000: Telegram API allows at most 10000 for the width " +
+				"and the height together.",
+			Value:   0,
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_PHOTO_MAX_DIMENSION"},
+		},
+		&cli.UintFlag{
+			Name:    "forwarded-attachment-photo-quality",
+			Usage:   "JPEG quality of the downscaled photos, from 1 to 100",
+			Value:   85,
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_PHOTO_QUALITY"},
+		},
+		&cli.BoolFlag{
+			Name:    "forwarded-attachment-photo-send-original",
+			Usage:   "Send the original of a downscaled photo as a document as well",
+			Value:   false,
+			EnvVars: []string{"ST_FORWARDED_ATTACHMENT_PHOTO_SEND_ORIGINAL"},
+		},
 		&cli.BoolFlag{
 			Name: "forwarded-attachment-respect-errors",
 			Usage: "Reject the whole email if some attachments " +
@@ -216,6 +564,42 @@ func main() {
 			Value:   4095,
 			EnvVars: []string{"ST_MESSAGE_LENGTH_TO_SEND_AS_FILE"},
 		},
+		&cli.StringFlag{
+			Name: "long-message-mode",
+			Usage: "What to do with the messages longer than `message-length-to-send-as-file`: " +
+				"file (truncate and attach the full message as a text file) or " +
+				"split (send the body in several messages marked with (2/5), " +
+				"as the replies to the first one).",
+			Value:   LONG_MESSAGE_MODE_FILE,
+			EnvVars: []string{"ST_LONG_MESSAGE_MODE"},
+		},
+		&cli.StringFlag{
+			Name: "spool-dir",
+			Usage: "Directory where accepted emails are stored until they are " +
+				"delivered to Telegram. When set, emails are accepted right away " +
+				"and delivered by a background worker which retries failures. " +
+				"Empty -- deliver synchronously and reject the email on failure.",
+			Value:   "",
+			EnvVars: []string{"ST_SPOOL_DIR"},
+		},
+		&cli.DurationFlag{
+			Name:    "spool-max-age",
+			Usage:   "Spool: give up delivering an email after this time. Examples: 30m, 24h.",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"ST_SPOOL_MAX_AGE"},
+		},
+		&cli.DurationFlag{
+			Name:    "spool-retry-min-delay",
+			Usage:   "Spool: delay before the first retry, doubled after each failed attempt",
+			Value:   10 * time.Second,
+			EnvVars: []string{"ST_SPOOL_RETRY_MIN_DELAY"},
+		},
+		&cli.DurationFlag{
+			Name:    "spool-retry-max-delay",
+			Usage:   "Spool: max delay between retries",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"ST_SPOOL_RETRY_MAX_DELAY"},
+		},
 		&cli.StringFlag{
 			Name:    "log-level",
 			Usage:   "Logging level (info, debug, error, panic).",
@@ -223,15 +607,83 @@ func main() {
 			EnvVars: []string{"ST_LOG_LEVEL"},
 		},
 	}
-	err := app.Run(os.Args)
+	return app
+}
+
+// Server is a running SMTP server which forwards emails to Telegram.
+type Server struct {
+	daemon guerrilla.Daemon
+	front  *SmtpFront
+	spool  *Spool
+	// Closed to stop watching the certificate of guerrilla.
+	certificatesStop chan struct{}
+	http             *http.Server
+	healthChecker    *TelegramHealthChecker
+	smtpConfig       *SmtpConfig
+	telegramConfig   atomic.Pointer[TelegramConfig]
+	// Whether the SMTP listener is up.
+	ready atomic.Bool
+}
+
+func (s *Server) Shutdown() {
+	s.ready.Store(false)
+	if s.healthChecker != nil {
+		s.healthChecker.Stop()
+	}
+	if s.http != nil {
+		s.shutdownHttp()
+	}
+	if s.certificatesStop != nil {
+		close(s.certificatesStop)
+	}
+	if s.front != nil {
+		s.front.Shutdown()
+	}
+	s.daemon.Shutdown()
+	if s.front != nil {
+		s.front.Wait()
+	}
+	// Stopped after the backend, which might be spooling an email.
+	if s.spool != nil {
+		s.spool.Stop()
+	}
+}
+
+// ReloadTelegramConfig atomically replaces the Telegram config.
+// The emails being processed keep using the previous config.
+func (s *Server) ReloadTelegramConfig(telegramConfig *TelegramConfig) {
+	old := s.telegramConfig.Load()
+	if telegramConfig.rateLimiter == nil {
+		if old.telegramRateLimitPerChat == telegramConfig.telegramRateLimitPerChat &&
+			old.telegramRateLimitGlobal == telegramConfig.telegramRateLimitGlobal {
+			// Keep the state of the token buckets.
+			telegramConfig.rateLimiter = old.rateLimiter
+		} else {
+			telegramConfig.rateLimiter = NewTelegramRateLimiter(
+				telegramConfig.telegramRateLimitPerChat,
+				telegramConfig.telegramRateLimitGlobal,
+			)
+		}
+	}
+	s.telegramConfig.Store(telegramConfig)
+}
+
+// ReloadConfig re-reads the config and swaps the Telegram config.
+// An invalid config is refused and the current one is kept.
+func (s *Server) ReloadConfig(c *cli.Context) error {
+	smtpConfig, telegramConfig, err := LoadConfig(c)
 	if err != nil {
-		fmt.Printf("%s\n", err)
-		os.Exit(1)
+		return err
+	}
+	if !reflect.DeepEqual(smtpConfig, s.smtpConfig) {
+		logger.Warn("Changes of the SMTP options require a restart, ignoring them")
 	}
+	s.ReloadTelegramConfig(telegramConfig)
+	return nil
 }
 
 func SmtpStart(
-	smtpConfig *SmtpConfig, telegramConfig *TelegramConfig) (guerrilla.Daemon, error) {
+	smtpConfig *SmtpConfig, telegramConfig *TelegramConfig) (*Server, error) {
 
 	cfg := &guerrilla.AppConfig{LogFile: log.OutputStdout.String(), LogLevel: smtpConfig.logLevel}
 
@@ -242,39 +694,167 @@ func SmtpStart(
 		ListenInterface: smtpConfig.smtpListen,
 		MaxSize:         smtpConfig.smtpMaxEnvelopeSize,
 	}
+	server := &Server{smtpConfig: smtpConfig}
+	if SmtpFrontRequired(smtpConfig) {
+		// guerrilla is hidden behind the front.
+		backendAddr, err := ReserveLoopbackAddress()
+		if err != nil {
+			return nil, err
+		}
+		server.front, err = NewSmtpFront(smtpConfig, &server.telegramConfig, backendAddr)
+		if err != nil {
+			return nil, err
+		}
+		sc.ListenInterface = backendAddr
+		sc.XClientOn = true
+	} else if smtpConfig.smtpTlsCertFile != "" {
+		sc.TLS = guerrilla.ServerTLSConfig{
+			StartTLSOn:     true,
+			PublicKeyFile:  smtpConfig.smtpTlsCertFile,
+			PrivateKeyFile: smtpConfig.smtpTlsKeyFile,
+			Protocols:      []string{"tls1.2", "tls1.3"},
+		}
+	}
 	cfg.Servers = append(cfg.Servers, sc)
+	if sc.TLS.StartTLSOn && smtpConfig.smtpTlsListen != "" {
+		tlsSc := sc
+		tlsSc.ListenInterface = smtpConfig.smtpTlsListen
+		tlsSc.TLS.StartTLSOn = false
+		tlsSc.TLS.AlwaysOn = true
+		cfg.Servers = append(cfg.Servers, tlsSc)
+	}
 
 	bcfg := backends.BackendConfig{
 		"save_workers_size":  3,
 		"save_process":       "HeadersParser|Header|Hasher|TelegramBot",
 		"log_received_mails": true,
 		"primary_mail_host":  smtpConfig.smtpPrimaryHost,
-		"gw_save_timeout":    "600s", // Needs to be greater than ST_TELEGRAM_API_TIMEOUT_SECONDS
+		"gw_save_timeout":    smtpSaveTimeout.String(),
+		// Reject the recipients without a route early, at RCPT TO.
+		// Always enabled, since the routes might appear on reload.
+		"validate_process": "TelegramBot",
+	}
+	if server.front != nil {
+		bcfg["save_process"] = "SmtpFront|" + bcfg["save_process"].(string)
+		bcfg["validate_process"] = "SmtpFront|" + bcfg["validate_process"].(string)
 	}
 	cfg.BackendConfig = bcfg
 
-	daemon := guerrilla.Daemon{Config: cfg}
-	daemon.AddProcessor("TelegramBot", TelegramBotProcessorFactory(telegramConfig))
+	if telegramConfig.rateLimiter == nil {
+		telegramConfig.rateLimiter = NewTelegramRateLimiter(
+			telegramConfig.telegramRateLimitPerChat,
+			telegramConfig.telegramRateLimitGlobal,
+		)
+	}
+	server.telegramConfig.Store(telegramConfig)
+
+	var spool *Spool
+	if smtpConfig.spoolDir != "" {
+		var err error
+		spool, err = NewSpool(smtpConfig, func(e *mail.Envelope, deliveries map[string]*ChatDelivery) error {
+			return SendEmailToTelegram(e, server.telegramConfig.Load(), deliveries)
+		})
+		if err != nil {
+			return nil, err
+		}
+		server.spool = spool
+	}
+
+	server.daemon = guerrilla.Daemon{Config: cfg}
+	server.daemon.AddProcessor("TelegramBot", TelegramBotProcessorFactory(&server.telegramConfig, spool))
+	if server.front != nil {
+		server.daemon.AddProcessor("SmtpFront", server.front.ProcessorFactory)
+	}
 
-	logger = daemon.Log()
+	logger = server.daemon.Log()
 
-	err := daemon.Start()
-	return daemon, err
+	err := server.daemon.Start()
+	if err == nil && server.spool != nil {
+		server.spool.Start()
+	}
+	if err == nil && server.front != nil {
+		err = server.front.Start()
+	}
+	if err == nil && sc.TLS.StartTLSOn {
+		server.certificatesStop = make(chan struct{})
+		go WatchCertificateFiles(
+			smtpConfig.smtpTlsCertFile, smtpConfig.smtpTlsKeyFile, server.certificatesStop,
+			func() {
+				for _, serverConfig := range cfg.Servers {
+					server.daemon.Publish(guerrilla.EventConfigServerTLSConfig, &serverConfig)
+				}
+			},
+		)
+	}
+	if err == nil && smtpConfig.httpListen != "" {
+		if smtpConfig.healthCheckInterval > 0 {
+			server.healthChecker = NewTelegramHealthChecker(&server.telegramConfig, smtpConfig.healthCheckInterval)
+			server.healthChecker.Start()
+		}
+		err = server.StartHttp()
+	}
+	server.ready.Store(err == nil)
+	return server, err
 }
 
 func TelegramBotProcessorFactory(
-	telegramConfig *TelegramConfig) func() backends.Decorator {
+	telegramConfigStore *atomic.Pointer[TelegramConfig], spool *Spool) func() backends.Decorator {
 	return func() backends.Decorator {
 		// https://github.com/flashmob/go-guerrilla/wiki/Backends,-configuring-and-extending
 
 		return func(p backends.Processor) backends.Processor {
 			return backends.ProcessWith(
 				func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+					// The config might be reloaded at any moment, so it is
+					// loaded exactly once per task.
+					telegramConfig := telegramConfigStore.Load()
 					if task == backends.TaskSaveMail {
-						err := SendEmailToTelegram(e, telegramConfig)
+						mailsReceived.Inc()
+						envelopeSize.Observe(float64(e.Data.Len()))
+						if spool != nil {
+							// The email is accepted once spooled, so it's rejected
+							// or dropped by the rules beforehand.
+							switch verdict := ApplyTelegramRulesBeforeSpooling(e, telegramConfig); verdict.action {
+							case RULE_ACTION_REJECT:
+								mailsRejected.WithLabelValues(REJECT_REASON_REJECTED).Inc()
+								err := &RejectedError{message: verdict.rejectMessage}
+								return backends.NewResult(fmt.Sprintf("554 Error: %s", err)), err
+							case RULE_ACTION_DROP:
+								logger.Infof("Dropping email %s from %s by a rule", e.QueuedId, e.MailFrom.String())
+								mailsAccepted.Inc()
+								return p.Process(e, task)
+							}
+							err := spool.Enqueue(e)
+							if err != nil {
+								mailsRejected.WithLabelValues(REJECT_REASON_SPOOL_ERROR).Inc()
+								return backends.NewResult(fmt.Sprintf("421 Error: unable to spool: %s", err)), err
+							}
+							mailsAccepted.Inc()
+							return p.Process(e, task)
+						}
+						err := SendEmailToTelegram(e, telegramConfig, nil)
+						if IsRejectedError(err) {
+							mailsRejected.WithLabelValues(REJECT_REASON_REJECTED).Inc()
+							return backends.NewResult(fmt.Sprintf("554 Error: %s", err)), err
+						}
+						if IsFormatError(err) {
+							mailsRejected.WithLabelValues(REJECT_REASON_FORMAT_ERROR).Inc()
+							return backends.NewResult(fmt.Sprintf("421 Error: %s", err)), err
+						}
 						if err != nil {
+							mailsRejected.WithLabelValues(REJECT_REASON_TELEGRAM_ERROR).Inc()
 							return backends.NewResult(fmt.Sprintf("421 Error: %s", err)), err
 						}
+						mailsAccepted.Inc()
+						return p.Process(e, task)
+					}
+					if task == backends.TaskValidateRcpt && len(e.RcptTo) > 0 {
+						// Only the last recipient has to be validated.
+						_, err := RouteChatIds(e.RcptTo[len(e.RcptTo)-1], telegramConfig)
+						if err != nil {
+							commandsRejected.WithLabelValues(REJECT_REASON_NO_ROUTE).Inc()
+							return backends.NewResult(fmt.Sprintf("550 Error: %s", err)), err
+						}
 						return p.Process(e, task)
 					}
 					return p.Process(e, task)
@@ -284,27 +864,97 @@ func TelegramBotProcessorFactory(
 	}
 }
 
+// ChatDelivery is the progress of delivering an email to a chat.
+// A retry resumes from where the previous attempt has stopped,
+// so that the chat doesn't receive the same parts again.
+type ChatDelivery struct {
+	// The id of the sent message, empty until it's sent.
+	MessageId json.Number `json:"message_id,omitempty"`
+	// The number of the sent replies and attachment groups.
+	Replies          int  `json:"replies,omitempty"`
+	AttachmentGroups int  `json:"attachment_groups,omitempty"`
+	Done             bool `json:"done,omitempty"`
+}
+
+// SendEmailToTelegram delivers the email to its chats. `deliveries`
+// is updated with the progress of each of the chats, nil when
+// the email isn't going to be retried.
 func SendEmailToTelegram(e *mail.Envelope,
-	telegramConfig *TelegramConfig) error {
+	telegramConfig *TelegramConfig, deliveries map[string]*ChatDelivery) error {
 
 	message, err := FormatEmail(e, telegramConfig)
 	if err != nil {
-		return err
+		return &FormatError{err: err}
 	}
 
-	client := http.Client{
-		Timeout: time.Duration(telegramConfig.telegramApiTimeoutSeconds*1000) * time.Millisecond,
+	verdict := ApplyTelegramRules(e, message.env, message.body, telegramConfig)
+	switch verdict.action {
+	case RULE_ACTION_DROP:
+		logger.Infof("Dropping email %s from %s by a rule", e.QueuedId, e.MailFrom.String())
+		return nil
+	case RULE_ACTION_REJECT:
+		return &RejectedError{message: verdict.rejectMessage}
+	}
+	if verdict.template != "" {
+		ruleTelegramConfig := *telegramConfig
+		ruleTelegramConfig.messageTemplate = verdict.template
+		message, err = FormatEmail(e, &ruleTelegramConfig)
+		if err != nil {
+			return &FormatError{err: err}
+		}
 	}
 
-	for _, chatId := range strings.Split(telegramConfig.telegramChatIds, ",") {
-		sentMessage, err := SendMessageToChat(message, chatId, telegramConfig, &client)
+	chatIds := verdict.chatIds
+	if len(chatIds) == 0 {
+		chatIds, err = RouteEnvelopeChatIds(e.RcptTo, telegramConfig)
 		if err != nil {
-			// If unable to send at least one message -- reject the whole email.
-			return errors.New(SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+			return err
 		}
+	}
 
-		for _, attachment := range message.attachments {
-			err = SendAttachmentToChat(attachment, chatId, telegramConfig, &client, sentMessage)
+	client := NewTelegramHttpClient(telegramConfig)
+	// The attachments uploaded to the first chat are sent
+	// to the next ones by their file_id.
+	sent := NewSentAttachments()
+	if deliveries == nil {
+		deliveries = map[string]*ChatDelivery{}
+	}
+
+	for _, chatId := range chatIds {
+		delivery := deliveries[chatId]
+		if delivery == nil {
+			delivery = &ChatDelivery{}
+			deliveries[chatId] = delivery
+		}
+		if delivery.Done {
+			continue
+		}
+		routeSilent, routeProtectContent := RouteChatOptions(e.RcptTo, chatId, telegramConfig)
+		message.silent = verdict.silent || routeSilent
+		message.protectContent = verdict.protectContent || routeProtectContent
+
+		if delivery.MessageId == "" {
+			sentMessage, err := SendMessageToChat(message, chatId, telegramConfig, client)
+			if err != nil {
+				// If unable to send at least one message -- reject the whole email.
+				return errors.New(SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+			}
+			delivery.MessageId = sentMessage.MessageId
+			attachments.WithLabelValues("discarded").Add(float64(message.discardedAttachments))
+		}
+		sentMessage := &TelegramAPIMessage{MessageId: delivery.MessageId}
+		for _, reply := range message.replies[min(delivery.Replies, len(message.replies)):] {
+			err = SendReplyToChat(reply, chatId, telegramConfig, client, sentMessage, message.protectContent)
+			if err != nil {
+				return errors.New(SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+			}
+			delivery.Replies++
+		}
+
+		groups := GroupAttachments(message.attachments)
+		for _, group := range groups[min(delivery.AttachmentGroups, len(groups)):] {
+			err = SendAttachmentGroupToChat(
+				group, chatId, telegramConfig, client, sentMessage, message.protectContent, sent)
 			if err != nil {
 				err = errors.New(SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
 				if telegramConfig.forwardedAttachmentRespectErrors {
@@ -313,47 +963,82 @@ func SendEmailToTelegram(e *mail.Envelope,
 					logger.Errorf("Ignoring attachment sending error: %s", err)
 				}
 			}
+			delivery.AttachmentGroups++
 		}
+		delivery.Done = true
 	}
 	return nil
 }
 
+func NewTelegramHttpClient(telegramConfig *TelegramConfig) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(telegramConfig.telegramApiTimeoutSeconds*1000) * time.Millisecond,
+	}
+}
+
 func SendMessageToChat(
 	message *FormattedEmail,
 	chatId string,
 	telegramConfig *TelegramConfig,
 	client *http.Client,
 ) (*TelegramAPIMessage, error) {
-	// The native golang's http client supports
-	// http, https and socks5 proxies via HTTP_PROXY/HTTPS_PROXY env vars
-	// out of the box.
-	//
-	// See: https://golang.org/pkg/net/http/#ProxyFromEnvironment
-	resp, err := client.PostForm(
-		// https://core.telegram.org/bots/api#sendmessage
-		fmt.Sprintf(
-			"%sbot%s/sendMessage?disable_web_page_preview=true",
-			telegramConfig.telegramApiPrefix,
-			telegramConfig.telegramBotToken,
-		),
-		url.Values{"chat_id": {chatId}, "text": {message.text}},
-	)
-	if err != nil {
-		return nil, err
+	form := NewSendMessageForm(message.text, chatId, telegramConfig)
+	form.Set("disable_notification", fmt.Sprintf("%t", message.silent))
+	form.Set("protect_content", fmt.Sprintf("%t", message.protectContent))
+	return CallSendMessage(form, chatId, telegramConfig, client)
+}
+
+// SendReplyToChat sends a part of a split message
+// as a silent reply to its first part.
+func SendReplyToChat(
+	text string,
+	chatId string,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+	protectContent bool,
+) error {
+	form := NewSendMessageForm(text, chatId, telegramConfig)
+	form.Set("reply_to_message_id", fmt.Sprintf("%s", sentMessage.MessageId))
+	form.Set("disable_notification", "true")
+	form.Set("protect_content", fmt.Sprintf("%t", protectContent))
+	_, err := CallSendMessage(form, chatId, telegramConfig, client)
+	return err
+}
+
+func NewSendMessageForm(text string, chatId string, telegramConfig *TelegramConfig) url.Values {
+	chat, thread := SplitChatThread(chatId)
+	form := url.Values{
+		"chat_id":                  {chat},
+		"text":                     {text},
+		"disable_web_page_preview": {"true"},
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, errors.New(fmt.Sprintf(
-			"Non-200 response from Telegram: (%d) %s",
-			resp.StatusCode,
-			EscapeMultiLine(body),
-		))
+	if thread != "" {
+		form.Set("message_thread_id", thread)
 	}
+	if telegramConfig.messageParseMode != PARSE_MODE_NONE {
+		form.Set("parse_mode", telegramConfig.messageParseMode)
+	}
+	return form
+}
 
-	j, err := ioutil.ReadAll(resp.Body)
+func CallSendMessage(
+	form url.Values,
+	chatId string,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+) (*TelegramAPIMessage, error) {
+	j, err := CallTelegramApi(
+		// https://core.telegram.org/bots/api#sendmessage
+		"sendMessage",
+		chatId,
+		"application/x-www-form-urlencoded",
+		[]byte(form.Encode()),
+		telegramConfig,
+		client,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading json body of sendMessage: %v", err)
+		return nil, err
 	}
 	result := &TelegramAPIMessageResult{}
 	err = json.Unmarshal(j, result)
@@ -366,102 +1051,394 @@ func SendMessageToChat(
 	return result.Result, nil
 }
 
+// SendAttachmentToChat sends the attachment as a reply to the message.
+// The `file_id` of the attachment already sent to another chat is reused
+// instead of uploading it again, the one of the uploaded attachment
+// is added to `sent` for the next chats.
 func SendAttachmentToChat(
 	attachment *FormattedAttachment,
 	chatId string,
 	telegramConfig *TelegramConfig,
 	client *http.Client,
 	sentMessage *TelegramAPIMessage,
+	protectContent bool,
+	sent *SentAttachments,
 ) error {
+	fileType := sent.FileType(attachment)
+	typeMethod, ok := attachmentTypeMethods[fileType]
+	if !ok {
+		panic(fmt.Errorf("Unknown file type %d", fileType))
+	}
+	method, field := typeMethod.method, typeMethod.field
+
+	if fileId := sent.fileIds[attachment]; fileId != "" {
+		j, err := callSendAttachment(
+			method, field, attachment, fileId, chatId, telegramConfig, client, sentMessage, protectContent)
+		if err == nil {
+			attachments.WithLabelValues("sent").Inc()
+			sent.fileIds[attachment] = ParseSentFileId(j, fileId)
+			return nil
+		}
+		logger.Infof("Unable to reuse file_id of %s, uploading it again: %s",
+			attachment.filename, SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+	}
+	j, err := callSendAttachment(
+		method, field, attachment, "", chatId, telegramConfig, client, sentMessage, protectContent)
+	// Telegram refuses the media it can't process, e.g. a video
+	// of an unsupported codec, but might accept it as a document.
+	if err != nil && fileType != ATTACHMENT_TYPE_DOCUMENT && IsTelegramBadRequest(err) &&
+		len(attachment.content) <= telegramConfig.forwardedAttachmentMaxSize {
+		logger.Infof("Unable to send %s with %s, sending it as a document: %s",
+			attachment.filename, method, SanitizeBotToken(err.Error(), telegramConfig.telegramBotToken))
+		// The rest of the chats get the document too, reusing its file_id.
+		sent.documents[attachment] = true
+		delete(sent.fileIds, attachment)
+		return SendAttachmentToChat(attachment, chatId, telegramConfig, client, sentMessage, protectContent, sent)
+	}
+	if err != nil {
+		attachments.WithLabelValues("failed").Inc()
+		return err
+	}
+	attachments.WithLabelValues("sent").Inc()
+	sent.fileIds[attachment] = ParseSentFileId(j, "")
+	return nil
+}
+
+// callSendAttachment uploads the attachment, or sends the `file_id`
+// of the uploaded one if it's not empty.
+func callSendAttachment(
+	method string,
+	field string,
+	attachment *FormattedAttachment,
+	fileId string,
+	chatId string,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+	protectContent bool,
+) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	w := multipart.NewWriter(buf)
-	var method string
-	// https://core.telegram.org/bots/api#sending-files
-	if attachment.fileType == ATTACHMENT_TYPE_DOCUMENT {
-		// https://core.telegram.org/bots/api#senddocument
-		method = "sendDocument"
-		panicIfError(w.WriteField("chat_id", chatId))
-		panicIfError(w.WriteField("reply_to_message_id", fmt.Sprintf("%s", sentMessage.MessageId)))
-		panicIfError(w.WriteField("caption", attachment.caption))
-		// TODO maybe reuse files sent to multiple chats via file_id?
-		dw, err := w.CreateFormFile("document", attachment.filename)
-		panicIfError(err)
-		_, err = dw.Write(attachment.content)
-		panicIfError(err)
-	} else if attachment.fileType == ATTACHMENT_TYPE_PHOTO {
-		// https://core.telegram.org/bots/api#sendphoto
-		method = "sendPhoto"
-		panicIfError(w.WriteField("chat_id", chatId))
-		panicIfError(w.WriteField("reply_to_message_id", fmt.Sprintf("%s", sentMessage.MessageId)))
-		panicIfError(w.WriteField("caption", attachment.caption))
-		// TODO maybe reuse files sent to multiple chats via file_id?
-		dw, err := w.CreateFormFile("photo", attachment.filename)
+	WriteChatIdFields(w, chatId)
+	panicIfError(w.WriteField("reply_to_message_id", fmt.Sprintf("%s", sentMessage.MessageId)))
+	panicIfError(w.WriteField("caption", attachment.caption))
+	if fileId != "" {
+		panicIfError(w.WriteField(field, fileId))
+	} else {
+		dw, err := w.CreateFormFile(field, attachment.filename)
 		panicIfError(err)
 		_, err = dw.Write(attachment.content)
 		panicIfError(err)
-	} else {
-		panic(fmt.Errorf("Unknown file type %d", attachment.fileType))
 	}
+	panicIfError(w.WriteField("disable_notification", "true"))
+	panicIfError(w.WriteField("protect_content", fmt.Sprintf("%t", protectContent)))
 	w.Close()
 
-	resp, err := client.Post(
-		fmt.Sprintf(
-			"%sbot%s/%s?disable_notification=true",
-			telegramConfig.telegramApiPrefix,
-			telegramConfig.telegramBotToken,
-			method,
-		),
+	return CallTelegramApi(
+		method,
+		chatId,
 		w.FormDataContentType(),
-		buf,
+		buf.Bytes(),
+		telegramConfig,
+		client,
+	)
+}
+
+// WriteChatIdFields writes `chat_id` and `message_thread_id`
+// of the chat id in the form of `chatid:threadid`.
+func WriteChatIdFields(w *multipart.Writer, chatId string) {
+	chat, thread := SplitChatThread(chatId)
+	panicIfError(w.WriteField("chat_id", chat))
+	if thread != "" {
+		panicIfError(w.WriteField("message_thread_id", thread))
+	}
+}
+
+// ParseSentFileId returns the `file_id` of the file or the largest
+// photo in the response of sendDocument, sendPhoto and the like,
+// `fallback` if there is none.
+func ParseSentFileId(j []byte, fallback string) string {
+	result := &TelegramAPIMessageResult{}
+	if err := json.Unmarshal(j, result); err != nil {
+		return fallback
+	}
+	return SentFileId(result.Result, fallback)
+}
+
+// SentFileId returns the `file_id` of the file or the largest photo
+// of the message, `fallback` if there is none.
+func SentFileId(message *TelegramAPIMessage, fallback string) string {
+	if message == nil {
+		return fallback
+	}
+	// An animation comes with a document as well.
+	for _, file := range []*TelegramAPIFile{
+		message.Animation, message.Video, message.Audio, message.Voice, message.Document,
+	} {
+		if file != nil && file.FileId != "" {
+			return file.FileId
+		}
+	}
+	if photos := message.Photo; len(photos) > 0 && photos[len(photos)-1].FileId != "" {
+		return photos[len(photos)-1].FileId
+	}
+	return fallback
+}
+
+// GetMe returns the bot user, checking that the Telegram API is
+// reachable and the bot token is valid.
+func GetMe(telegramConfig *TelegramConfig, client *http.Client) (*TelegramAPIUser, error) {
+	j, err := CallTelegramApi(
+		// https://core.telegram.org/bots/api#getme
+		"getMe",
+		"",
+		"application/x-www-form-urlencoded",
+		nil,
+		telegramConfig,
+		client,
 	)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := &TelegramAPIUserResult{}
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing json body of getMe: %v", err)
+	}
+	if result.Ok != true || result.Result == nil {
+		return nil, fmt.Errorf("ok != true: %s", j)
+	}
+	return result.Result, nil
+}
+
+func GetChat(chatId string, telegramConfig *TelegramConfig, client *http.Client) (*TelegramAPIChat, error) {
+	j, err := CallTelegramApi(
+		// https://core.telegram.org/bots/api#getchat
+		"getChat",
+		chatId,
+		"application/x-www-form-urlencoded",
+		[]byte(url.Values{"chat_id": {chatId}}.Encode()),
+		telegramConfig,
+		client,
+	)
+	if err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf(
-			"Non-200 response from Telegram: (%d) %s",
-			resp.StatusCode,
-			EscapeMultiLine(body),
-		))
+	result := &TelegramAPIChatResult{}
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing json body of getChat: %v", err)
+	}
+	if result.Ok != true || result.Result == nil {
+		return nil, fmt.Errorf("ok != true: %s", j)
+	}
+	return result.Result, nil
+}
+
+// CallTelegramApi posts the body to the Telegram API method and returns
+// the response body. The requests are throttled by the rate limiter,
+// and the ones rejected by the flood control are retried after
+// the `retry_after` delay requested by Telegram.
+func CallTelegramApi(
+	method string,
+	chatId string,
+	contentType string,
+	body []byte,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+) ([]byte, error) {
+	// The threads share the rate limit of their chat.
+	chatId, _ = SplitChatThread(chatId)
+	waited := time.Duration(0)
+	for {
+		telegramConfig.rateLimiter.Wait(chatId)
+		// The native golang's http client supports
+		// http, https and socks5 proxies via HTTP_PROXY/HTTPS_PROXY env vars
+		// out of the box.
+		//
+		// See: https://golang.org/pkg/net/http/#ProxyFromEnvironment
+		start := time.Now()
+		resp, err := client.Post(
+			fmt.Sprintf(
+				"%sbot%s/%s",
+				telegramConfig.telegramApiPrefix,
+				telegramConfig.telegramBotToken,
+				method,
+			),
+			contentType,
+			bytes.NewReader(body),
+		)
+		if err != nil {
+			telegramApiRequests.WithLabelValues(method, "error").Inc()
+			return nil, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		telegramApiDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		telegramApiRequests.WithLabelValues(method, strconv.Itoa(resp.StatusCode)).Inc()
+		if resp.StatusCode == 200 {
+			if err != nil {
+				return nil, fmt.Errorf("Error reading json body of %s: %v", method, err)
+			}
+			return respBody, nil
+		}
+		retryAfter := ParseTelegramRetryAfter(resp.StatusCode, respBody)
+		if retryAfter > 0 && waited+retryAfter <= telegramConfig.telegramFloodMaxWait {
+			logger.Warnf(
+				"Telegram flood control hit for chat %s, retrying after %s",
+				chatId, retryAfter,
+			)
+			time.Sleep(retryAfter)
+			waited += retryAfter
+			continue
+		}
+		return nil, &TelegramApiError{statusCode: resp.StatusCode, body: respBody}
+	}
+}
+
+// TelegramApiError is a non-200 response of the Telegram API.
+type TelegramApiError struct {
+	statusCode int
+	body       []byte
+}
+
+func (e *TelegramApiError) Error() string {
+	return fmt.Sprintf("Non-200 response from Telegram: (%d) %s", e.statusCode, EscapeMultiLine(e.body))
+}
+
+// IsTelegramBadRequest tells whether Telegram has refused the request
+// itself, unlike the network errors and the server ones.
+func IsTelegramBadRequest(err error) bool {
+	var apiError *TelegramApiError
+	return errors.As(err, &apiError) && apiError.statusCode == http.StatusBadRequest
+}
+
+// ParseTelegramRetryAfter returns the delay requested by Telegram
+// in a 429 Too Many Requests response, or 0 if there's none.
+func ParseTelegramRetryAfter(statusCode int, body []byte) time.Duration {
+	if statusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	result := &TelegramAPIErrorResult{}
+	if err := json.Unmarshal(body, result); err != nil || result.Parameters == nil {
+		return 0
+	}
+	return time.Duration(result.Parameters.RetryAfter) * time.Second
+}
+
+// FormatError is an error of parsing or formatting the email.
+type FormatError struct {
+	err error
+}
+
+func (e *FormatError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.err
+}
+
+func IsFormatError(err error) bool {
+	var formatError *FormatError
+	return errors.As(err, &formatError)
+}
+
+// EmailBodyPart returns the text/plain part which is used as the body
+// of the email without the text, nil when there is no such part.
+func EmailBodyPart(env *enmime.Envelope) *enmime.Part {
+	if env.Text != "" {
+		return nil
+	}
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.Attachments} {
+		for _, part := range parts {
+			if len(part.Content) > 0 && part.ContentType == "text/plain" && part.FileName == "" {
+				return part
+			}
+		}
 	}
 	return nil
 }
 
+// EmailBody returns the plain text body of the email, falling back
+// to the converted HTML and then to the raw email.
+func EmailBody(e *mail.Envelope, env *enmime.Envelope) string {
+	if env.Text != "" {
+		return env.Text
+	}
+	if part := EmailBodyPart(env); part != nil {
+		return string(part.Content)
+	}
+	if strings.TrimSpace(env.HTML) != "" {
+		if text := HtmlToText(env.HTML); text != "" {
+			return text
+		}
+	}
+	return e.Data.String()
+}
+
 func FormatEmail(e *mail.Envelope, telegramConfig *TelegramConfig) (*FormattedEmail, error) {
+	defer func(start time.Time) {
+		formatEmailDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
 	reader := e.NewReader()
-	env, err := enmime.ReadEnvelope(reader)
+	// The HTML-only emails are converted by HtmlToText instead.
+	env, err := enmime.NewParser(enmime.DisableTextConversion(true)).ReadEnvelope(reader)
 	if err != nil {
 		return nil, fmt.Errorf("%s\n\nError occurred during email parsing: %v", e, err)
 	}
-	text := env.Text
+	bodyPart := EmailBodyPart(env)
+	text := EmailBody(e, env)
 
 	attachmentsDetails := []string{}
 	attachments := []*FormattedAttachment{}
+	discardedAttachments := 0
+	templateAttachments := []*MessageTemplateAttachment{}
 
-	doParts := func(emoji string, parts []*enmime.Part) {
+	doParts := func(emoji string, disposition string, parts []*enmime.Part) {
 		for _, part := range parts {
 			if bytes.Compare(part.Content, []byte(env.Text)) == 0 {
 				continue
 			}
-			if text == "" && part.ContentType == "text/plain" && part.FileName == "" {
-				text = string(part.Content)
+			if part == bodyPart {
 				continue
 			}
 			action := "discarded"
 			contentType := GuessContentType(part.ContentType, part.FileName)
-			if FileIsImage(contentType) && len(part.Content) <= telegramConfig.forwardedAttachmentMaxPhotoSize {
+			fileType := FileAttachmentType(contentType, part.Content)
+			filename, content := part.FileName, part.Content
+			downscaled := false
+			if fileType == ATTACHMENT_TYPE_PHOTO && telegramConfig.forwardedAttachmentPhotoMaxDimension > 0 {
+				photo := DownscalePhoto(
+					part.Content,
+					telegramConfig.forwardedAttachmentPhotoMaxDimension,
+					telegramConfig.forwardedAttachmentPhotoQuality,
+					telegramConfig.forwardedAttachmentMaxPhotoSize,
+				)
+				if photo != nil {
+					filename, content, downscaled = DownscaledPhotoFilename(part.FileName), photo, true
+				}
+			}
+			if fileType == ATTACHMENT_TYPE_PHOTO && !FitsTelegramPhotoDimensions(content) {
+				fileType = ATTACHMENT_TYPE_DOCUMENT
+			}
+			if len(content) > telegramConfig.ForwardedAttachmentMaxSize(fileType) {
+				// Too large to be played inline, might be a document still.
+				fileType = ATTACHMENT_TYPE_DOCUMENT
+			}
+			if len(content) <= telegramConfig.ForwardedAttachmentMaxSize(fileType) {
 				action = "sending..."
+				if downscaled {
+					action = "downscaled, sending..."
+				}
 				attachments = append(attachments, &FormattedAttachment{
-					filename: part.FileName,
+					filename: filename,
 					caption:  part.FileName,
-					content:  part.Content,
-					fileType: ATTACHMENT_TYPE_PHOTO,
+					content:  content,
+					fileType: fileType,
 				})
-			} else {
-				if len(part.Content) <= telegramConfig.forwardedAttachmentMaxSize {
-					action = "sending..."
+				if downscaled && telegramConfig.forwardedAttachmentPhotoSendOriginal &&
+					len(part.Content) <= telegramConfig.forwardedAttachmentMaxSize {
 					attachments = append(attachments, &FormattedAttachment{
 						filename: part.FileName,
 						caption:  part.FileName,
@@ -470,6 +1447,9 @@ func FormatEmail(e *mail.Envelope, telegramConfig *TelegramConfig) (*FormattedEm
 					})
 				}
 			}
+			if action == "discarded" {
+				discardedAttachments++
+			}
 			line := fmt.Sprintf(
 				"- %s %s (%s) %s, %s",
 				emoji,
@@ -479,25 +1459,46 @@ func FormatEmail(e *mail.Envelope, telegramConfig *TelegramConfig) (*FormattedEm
 				action,
 			)
 			attachmentsDetails = append(attachmentsDetails, line)
+			templateAttachments = append(templateAttachments, &MessageTemplateAttachment{
+				Filename:    part.FileName,
+				ContentType: contentType,
+				Size:        len(part.Content),
+				HumanSize:   units.HumanSize(float64(len(part.Content))),
+				Disposition: disposition,
+				Action:      action,
+				Forwarded:   action != "discarded",
+			})
 		}
 	}
-	doParts("🔗", env.Inlines)
-	doParts("📎", env.Attachments)
+	doParts("🔗", "inline", env.Inlines)
+	doParts("📎", "attachment", env.Attachments)
 	for _, part := range env.OtherParts {
+		contentType := GuessContentType(part.ContentType, part.FileName)
 		line := fmt.Sprintf(
 			"- ❔ %s (%s) %s, discarded",
 			part.FileName,
-			GuessContentType(part.ContentType, part.FileName),
+			contentType,
 			units.HumanSize(float64(len(part.Content))),
 		)
 		attachmentsDetails = append(attachmentsDetails, line)
+		templateAttachments = append(templateAttachments, &MessageTemplateAttachment{
+			Filename:    part.FileName,
+			ContentType: contentType,
+			Size:        len(part.Content),
+			HumanSize:   units.HumanSize(float64(len(part.Content))),
+			Disposition: "other",
+			Action:      "discarded",
+		})
+		discardedAttachments++
 	}
 	for _, e := range env.Errors {
 		logger.Errorf("Envelope error: %s", e.Error())
 	}
 
-	if text == "" {
-		text = e.Data.String()
+	bodyHtml := ""
+	if env.Text == "" && bodyPart == nil && strings.TrimSpace(env.HTML) != "" &&
+		telegramConfig.messageParseMode == PARSE_MODE_HTML {
+		bodyHtml = HtmlToTelegramHtml(env.HTML)
 	}
 
 	formattedAttachmentsDetails := ""
@@ -508,96 +1509,232 @@ func FormatEmail(e *mail.Envelope, telegramConfig *TelegramConfig) (*FormattedEm
 		)
 	}
 
-	fullMessageText, truncatedMessageText := FormatMessage(
-		e.MailFrom.String(),
-		JoinEmailAddresses(e.RcptTo),
-		env.GetHeader("subject"),
-		text,
-		formattedAttachmentsDetails,
-		telegramConfig,
-	)
+	data := &MessageTemplateData{
+		From:               e.MailFrom.String(),
+		To:                 JoinEmailAddresses(e.RcptTo),
+		Subject:            env.GetHeader("subject"),
+		Body:               text,
+		BodyHtml:           bodyHtml,
+		MessageID:          env.GetHeader("message-id"),
+		SenderIP:           e.RemoteIP,
+		Helo:               e.Helo,
+		Headers:            EnvelopeHeaders(env),
+		Attachments:        templateAttachments,
+		AttachmentsDetails: formattedAttachmentsDetails,
+		env:                env,
+	}
+	if date, err := env.Date(); err == nil {
+		data.Date = date
+	} else {
+		data.Date = time.Now()
+	}
+	if telegramConfig.messageDateLocation != nil {
+		data.Date = data.Date.In(telegramConfig.messageDateLocation)
+	}
+	fullMessageText, truncatedMessageText, err := FormatMessage(data, telegramConfig)
+	if err != nil {
+		return nil, err
+	}
+	if truncatedMessageText != "" && telegramConfig.longMessageMode == LONG_MESSAGE_MODE_SPLIT {
+		messages, err := SplitMessage(data, telegramConfig)
+		if err != nil {
+			return nil, err
+		}
+		// Otherwise the template is too long to be split.
+		if messages != nil {
+			return &FormattedEmail{
+				text:                 messages[0],
+				replies:              messages[1:],
+				attachments:          attachments,
+				discardedAttachments: discardedAttachments,
+				env:                  env,
+				body:                 text,
+			}, nil
+		}
+	}
 	if truncatedMessageText == "" { // no need to truncate
 		return &FormattedEmail{
-			text:        fullMessageText,
-			attachments: attachments,
+			text:                 fullMessageText,
+			attachments:          attachments,
+			discardedAttachments: discardedAttachments,
+			env:                  env,
+			body:                 text,
 		}, nil
 	} else {
-		if len(fullMessageText) > telegramConfig.forwardedAttachmentMaxSize {
+		fullMessageFileText, err := FormatFullMessageFile(data, telegramConfig)
+		if err != nil {
+			return nil, err
+		}
+		if len(fullMessageFileText) > telegramConfig.forwardedAttachmentMaxSize {
 			return nil, fmt.Errorf(
 				"The message length (%d) is larger than `forwarded-attachment-max-size` (%d)",
-				len(fullMessageText),
+				len(fullMessageFileText),
 				telegramConfig.forwardedAttachmentMaxSize,
 			)
 		}
 		at := &FormattedAttachment{
 			filename: "full_message.txt",
 			caption:  "Full message",
-			content:  []byte(fullMessageText),
+			content:  []byte(fullMessageFileText),
 			fileType: ATTACHMENT_TYPE_DOCUMENT,
 		}
 		attachments := append([]*FormattedAttachment{at}, attachments...)
 		return &FormattedEmail{
-			text:        truncatedMessageText,
-			attachments: attachments,
+			text:                 truncatedMessageText,
+			attachments:          attachments,
+			discardedAttachments: discardedAttachments,
+			env:                  env,
+			body:                 text,
 		}, nil
 	}
 }
 
+// MessageRenderer renders the message template with the body
+// replaced, so that the body can be truncated or split.
+type MessageRenderer struct {
+	parseMode string
+	// The body in the form expected by render: escaped for the parse
+	// mode by the `placeholders` engine, raw for the `go` one,
+	// which escapes it in the template.
+	body    string
+	escaped bool
+	render  func(body string) (string, error)
+}
+
+func NewMessageRenderer(data *MessageTemplateData, telegramConfig *TelegramConfig) (*MessageRenderer, error) {
+	parseMode := telegramConfig.messageParseMode
+	r := &MessageRenderer{
+		parseMode: parseMode,
+		body:      strings.TrimSpace(data.Body),
+	}
+	if telegramConfig.messageTemplateEngine == TEMPLATE_ENGINE_GO {
+		tmpl, err := ParseMessageTemplate(telegramConfig.messageTemplate, parseMode)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid message template: %s", err)
+		}
+		r.render = func(body string) (string, error) {
+			bodyData := *data
+			bodyData.Body = body
+			if body != r.body && bodyData.BodyHtml != "" {
+				// The formatted body can't be cut along with the body.
+				bodyData.BodyHtml = EscapeForParseMode(body, parseMode)
+			}
+			buf := new(strings.Builder)
+			if err := tmpl.Execute(buf, &bodyData); err != nil {
+				return "", fmt.Errorf("Unable to render the message template: %s", err)
+			}
+			return strings.TrimSpace(buf.String()), nil
+		}
+		return r, nil
+	}
+	// The values substituted into the placeholders are escaped.
+	r.escaped = true
+	if data.BodyHtml != "" && parseMode == PARSE_MODE_HTML {
+		r.body = data.BodyHtml
+	} else {
+		r.body = EscapeForParseMode(r.body, parseMode)
+	}
+	r.render = func(body string) (string, error) {
+		return strings.TrimSpace(
+			ReplacePlaceholders(telegramConfig.messageTemplate, func(placeholder string) (string, bool) {
+				if placeholder == "body" {
+					return body, true
+				}
+				value, ok := PlaceholderValue(placeholder, data, telegramConfig)
+				return EscapeForParseMode(value, parseMode), ok
+			}),
+		), nil
+	}
+	return r, nil
+}
+
+// BodyText converts the text in the form of the body to the message text.
+func (r *MessageRenderer) BodyText(s string) string {
+	if r.escaped {
+		return s
+	}
+	return EscapeForParseMode(s, r.parseMode)
+}
+
+// FromText converts the unescaped text to the form of the body.
+func (r *MessageRenderer) FromText(s string) string {
+	if r.escaped {
+		return EscapeForParseMode(s, r.parseMode)
+	}
+	return s
+}
+
+// TruncateBody cuts the body at a paragraph, a sentence or a word
+// boundary so that its message text is at most `limit` characters long.
+func (r *MessageRenderer) TruncateBody(body string, limit uint) string {
+	if r.escaped {
+		return TruncateText(body, limit, r.parseMode)
+	}
+	return TruncateTextBeforeEscaping(body, limit, r.parseMode)
+}
+
+// FormatMessage renders the message template. The second returned value
+// is the message truncated to `messageLengthToSendAsFile`, empty if it fits.
 func FormatMessage(
-	from string, to string, subject string, text string,
-	formattedAttachmentsDetails string,
+	data *MessageTemplateData,
 	telegramConfig *TelegramConfig,
-) (string, string) {
-	fullMessageText := strings.TrimSpace(
-		strings.NewReplacer(
-			"\\n", "\n",
-			"{from}", from,
-			"{to}", to,
-			"{subject}", subject,
-			"{body}", strings.TrimSpace(text),
-			"{attachments_details}", formattedAttachmentsDetails,
-		).Replace(telegramConfig.messageTemplate),
-	)
-	fullMessageRunes := []rune(fullMessageText)
-	if uint(len(fullMessageRunes)) <= telegramConfig.messageLengthToSendAsFile {
+) (string, string, error) {
+	r, err := NewMessageRenderer(data, telegramConfig)
+	if err != nil {
+		return "", "", err
+	}
+	parseMode := telegramConfig.messageParseMode
+	bodyTruncated := r.FromText(BodyTruncated)
+
+	fullMessageText, err := r.render(r.body)
+	if err != nil {
+		return "", "", err
+	}
+	if uint(TextLength(fullMessageText)) <= telegramConfig.messageLengthToSendAsFile {
 		// No need to truncate
-		return fullMessageText, ""
-	}
-
-	emptyMessageText := strings.TrimSpace(
-		strings.NewReplacer(
-			"\\n", "\n",
-			"{from}", from,
-			"{to}", to,
-			"{subject}", subject,
-			"{body}", strings.TrimSpace(fmt.Sprintf(".%s", BodyTruncated)),
-			"{attachments_details}", formattedAttachmentsDetails,
-		).Replace(telegramConfig.messageTemplate),
-	)
-	emptyMessageRunes := []rune(emptyMessageText)
-	if uint(len(emptyMessageRunes)) >= telegramConfig.messageLengthToSendAsFile {
+		return fullMessageText, "", nil
+	}
+
+	emptyMessageText, err := r.render(strings.TrimSpace("." + bodyTruncated))
+	if err != nil {
+		return "", "", err
+	}
+	emptyMessageLength := uint(TextLength(emptyMessageText))
+	if emptyMessageLength >= telegramConfig.messageLengthToSendAsFile {
 		// Impossible to truncate properly
-		return fullMessageText, string(fullMessageRunes[:telegramConfig.messageLengthToSendAsFile])
-	}
-
-	maxBodyLength := telegramConfig.messageLengthToSendAsFile - uint(len(emptyMessageRunes))
-	truncatedMessageText := strings.TrimSpace(
-		strings.NewReplacer(
-			"\\n", "\n",
-			"{from}", from,
-			"{to}", to,
-			"{subject}", subject,
-			// TODO cut by paragraphs + respect formatting
-			"{body}", strings.TrimSpace(fmt.Sprintf("%s%s",
-				string([]rune(strings.TrimSpace(text))[:maxBodyLength]), BodyTruncated)),
-			"{attachments_details}", formattedAttachmentsDetails,
-		).Replace(telegramConfig.messageTemplate),
-	)
-	if uint(len([]rune(truncatedMessageText))) > telegramConfig.messageLengthToSendAsFile {
-		panic(fmt.Errorf("Unexpected length of truncated message:\n%d\n%s",
-			maxBodyLength, truncatedMessageText))
+		return fullMessageText, TruncateFormatted(
+			fullMessageText, telegramConfig.messageLengthToSendAsFile, parseMode), nil
+	}
+
+	maxBodyLength := telegramConfig.messageLengthToSendAsFile - emptyMessageLength
+	truncatedMessageText, err := r.render(strings.TrimSpace(
+		r.TruncateBody(r.body, maxBodyLength) + bodyTruncated))
+	if err != nil {
+		return "", "", err
 	}
-	return fullMessageText, truncatedMessageText
+	if uint(TextLength(truncatedMessageText)) > telegramConfig.messageLengthToSendAsFile {
+		// The template renders the body more than once.
+		truncatedMessageText = TruncateFormatted(
+			truncatedMessageText, telegramConfig.messageLengthToSendAsFile, parseMode)
+	}
+	return fullMessageText, truncatedMessageText, nil
+}
+
+// FormatFullMessageFile renders the message template for
+// `full_message.txt`, which is a plain text file, so the values
+// aren't escaped for the parse mode.
+func FormatFullMessageFile(data *MessageTemplateData, telegramConfig *TelegramConfig) (string, error) {
+	plainTelegramConfig := *telegramConfig
+	plainTelegramConfig.messageParseMode = PARSE_MODE_NONE
+	plainData := *data
+	if plainData.BodyHtml != "" {
+		plainData.BodyHtml = plainData.Body
+	}
+	r, err := NewMessageRenderer(&plainData, &plainTelegramConfig)
+	if err != nil {
+		return "", err
+	}
+	return r.render(r.body)
 }
 
 func GuessContentType(contentType string, filename string) string {
@@ -608,19 +1745,74 @@ func GuessContentType(contentType string, filename string) string {
 	if guessedType != "" {
 		return guessedType
 	}
+	// Not in the builtin table of Go, unlike the images.
+	guessedType = mediaExtensionTypes[strings.ToLower(filepath.Ext(filename))]
+	if guessedType != "" {
+		return guessedType
+	}
 	return contentType // Give up
 }
 
-func FileIsImage(contentType string) bool {
+var mediaExtensionTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/opus",
+}
+
+// FileAttachmentType returns the type of the attachment to send
+// a file of the content type as.
+func FileAttachmentType(contentType string, content []byte) int {
 	switch contentType {
 	case
-		// "image/gif",  // sent as a static image
 		// "image/x-ms-bmp",  // rendered as document
 		"image/jpeg",
 		"image/png":
-		return true
+		return ATTACHMENT_TYPE_PHOTO
+	case "image/gif":
+		return ATTACHMENT_TYPE_ANIMATION
+	case "video/mp4":
+		return ATTACHMENT_TYPE_VIDEO
+	case "audio/mpeg", "audio/mp3", "audio/mp4", "audio/m4a", "audio/x-m4a":
+		return ATTACHMENT_TYPE_AUDIO
+	case "audio/ogg", "audio/opus":
+		if IsOggOpus(content) {
+			return ATTACHMENT_TYPE_VOICE
+		}
+	}
+	return ATTACHMENT_TYPE_DOCUMENT
+}
+
+// IsOggOpus tells whether the file is an Opus stream in an OGG container,
+// the only kind of the OGG files Telegram accepts as voices.
+func IsOggOpus(content []byte) bool {
+	// The first page holds the identification header of the stream:
+	// https://www.rfc-editor.org/rfc/rfc7845#section-3
+	const pageHeaderLength = 27
+	if len(content) < pageHeaderLength || !bytes.HasPrefix(content, []byte("OggS")) {
+		return false
 	}
-	return false
+	payload := pageHeaderLength + int(content[pageHeaderLength-1])
+	return len(content) >= payload && bytes.HasPrefix(content[payload:], []byte("OpusHead"))
+}
+
+// ForwardedAttachmentMaxSize returns the size limit of the attachment type.
+func (c *TelegramConfig) ForwardedAttachmentMaxSize(fileType int) int {
+	switch fileType {
+	case ATTACHMENT_TYPE_PHOTO:
+		return c.forwardedAttachmentMaxPhotoSize
+	case ATTACHMENT_TYPE_ANIMATION:
+		return c.forwardedAttachmentMaxAnimationSize
+	case ATTACHMENT_TYPE_VIDEO:
+		return c.forwardedAttachmentMaxVideoSize
+	case ATTACHMENT_TYPE_AUDIO:
+		return c.forwardedAttachmentMaxAudioSize
+	case ATTACHMENT_TYPE_VOICE:
+		return c.forwardedAttachmentMaxVoiceSize
+	}
+	return c.forwardedAttachmentMaxSize
 }
 
 func JoinEmailAddresses(a []mail.Address) string {
@@ -651,17 +1843,27 @@ func panicIfError(err error) {
 	}
 }
 
-func sigHandler(d guerrilla.Daemon) {
+func sigHandler(s *Server, c *cli.Context) {
 	signalChannel := make(chan os.Signal, 1)
 
 	signal.Notify(signalChannel,
+		syscall.SIGHUP,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
 		syscall.SIGINT,
 		syscall.SIGKILL,
 		os.Kill,
 	)
-	for range signalChannel {
+	for sig := range signalChannel {
+		if sig == syscall.SIGHUP {
+			logger.Info("Reload signal caught")
+			if err := s.ReloadConfig(c); err != nil {
+				logger.Errorf("Unable to reload config, keeping the current one: %s", err)
+			} else {
+				logger.Info("Config has been reloaded")
+			}
+			continue
+		}
 		logger.Info("Shutdown signal caught")
 		go func() {
 			select {
@@ -671,7 +1873,7 @@ func sigHandler(d guerrilla.Daemon) {
 				os.Exit(1)
 			}
 		}()
-		d.Shutdown()
+		s.Shutdown()
 		logger.Info("Shutdown completed, exiting.")
 		return
 	}
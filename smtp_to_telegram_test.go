@@ -3,17 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/smtp"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/flashmob/go-guerrilla"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/gomail.v2"
 )
 
@@ -43,7 +47,7 @@ func makeTelegramConfig() *TelegramConfig {
 	}
 }
 
-func startSmtp(smtpConfig *SmtpConfig, telegramConfig *TelegramConfig) guerrilla.Daemon {
+func startSmtp(smtpConfig *SmtpConfig, telegramConfig *TelegramConfig) *Server {
 	d, err := SmtpStart(smtpConfig, telegramConfig)
 	if err != nil {
 		panic(fmt.Sprintf("start error: %s", err))
@@ -140,6 +144,40 @@ func TestTelegramHttpError(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestTelegramFloodControlRetry(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramFloodMaxWait = 5 * time.Second
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := &FloodHandler{next: NewSuccessHandler(), floodedRequests: 1}
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, h.floodedRequests)
+	assert.Len(t, h.next.RequestMessages, len(strings.Split(telegramConfig.telegramChatIds, ",")))
+}
+
+func TestTelegramFloodControlExceedsMaxWait(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramFloodMaxWait = 0
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := &FloodHandler{next: NewSuccessHandler(), floodedRequests: 1}
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NotNil(t, err)
+	assert.Len(t, h.next.RequestMessages, 0)
+}
+
 func TestEncodedContent(t *testing.T) {
 	smtpConfig := makeSmtpConfig()
 	telegramConfig := makeTelegramConfig()
@@ -275,18 +313,19 @@ func TestAttachmentsSending(t *testing.T) {
 			content:  []byte("JPG"),
 			fileType: ATTACHMENT_TYPE_PHOTO,
 		},
-		&FormattedAttachment{
-			filename: "hey.txt",
-			caption:  "hey.txt",
-			content:  []byte("hi"),
-			fileType: ATTACHMENT_TYPE_DOCUMENT,
-		},
+		// The photos are sent as a media group.
 		&FormattedAttachment{
 			filename: "attachment.jpg",
 			caption:  "attachment.jpg",
 			content:  []byte("JPG"),
 			fileType: ATTACHMENT_TYPE_PHOTO,
 		},
+		&FormattedAttachment{
+			filename: "hey.txt",
+			caption:  "hey.txt",
+			content:  []byte("hi"),
+			fileType: ATTACHMENT_TYPE_DOCUMENT,
+		},
 	}
 
 	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
@@ -468,12 +507,13 @@ func TestLargeMessageWithAttachmentsProperlyTruncated(t *testing.T) {
 	assert.Len(t, h.RequestMessages, len(strings.Split(telegramConfig.telegramChatIds, ",")))
 	assert.Len(t, h.RequestDocuments, 2*len(strings.Split(telegramConfig.telegramChatIds, ",")))
 
+	// The 📎 is two UTF-16 code units long for Telegram.
 	exp :=
 		"From: from@test\n" +
 			"To: to@test\n" +
 			"Subject: Test subj\n" +
 			"\n" +
-			"Hel loHel loHel loHel loHel\n" +
+			"Hel loHel loHel loHel\n" +
 			"\n" +
 			"[truncated]\n" +
 			"\n" +
@@ -485,6 +525,208 @@ func TestLargeMessageWithAttachmentsProperlyTruncated(t *testing.T) {
 	}
 }
 
+func TestLargeMessageFileIsNotEscaped(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageLengthToSendAsFile = 100
+	telegramConfig.messageParseMode = PARSE_MODE_HTML
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	body := strings.Repeat("a < b & c\n", 20)
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"},
+		[]byte("Subject: <Test>\r\n\r\n"+body))
+	assert.NoError(t, err)
+
+	require.Len(t, h.RequestDocuments, len(strings.Split(telegramConfig.telegramChatIds, ",")))
+	assert.Equal(t, "full_message.txt", h.RequestDocuments[0].filename)
+	assert.Equal(t,
+		"From: from@test\nTo: to@test\nSubject: <Test>\n\n"+strings.TrimSpace(body),
+		string(h.RequestDocuments[0].content))
+	assert.Contains(t, h.RequestMessages[0], "a &lt; b &amp; c")
+}
+
+func TestAttachmentsFileIdReused(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxPhotoSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test subj")
+	m.SetBody("text/plain", "Hello")
+	m.Attach("report.pdf", goMailBody([]byte("PDF")))
+	m.Attach("photo.jpg", goMailBody([]byte("JPG")))
+
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	require.Len(t, h.RequestDocuments, 4)
+	// Uploaded to the first chat only.
+	assert.Equal(t, []string{"", "", "document-1", "photo-2"}, h.RequestFileIds)
+	assert.Equal(t, h.RequestDocuments[0], h.RequestDocuments[2])
+	assert.Equal(t, h.RequestDocuments[1], h.RequestDocuments[3])
+}
+
+func TestMediaAttachments(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramChatIds = "42"
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxAnimationSize = 1024
+	telegramConfig.forwardedAttachmentMaxVideoSize = 5
+	telegramConfig.forwardedAttachmentMaxAudioSize = 1024
+	telegramConfig.forwardedAttachmentMaxVoiceSize = 1024
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Doorbell")
+	m.SetBody("text/plain", "Ring")
+	m.Attach("doorbell.mp4", goMailBody([]byte("MP4")))
+	m.Attach("large.mp4", goMailBody([]byte("MP4MP4")))
+	m.Attach("loop.gif", goMailBody([]byte("GIF")))
+	m.Attach("song.mp3", goMailBody([]byte("MP3")))
+	m.Attach("note.m4a", goMailBody([]byte("M4A")))
+	m.Attach("voice.ogg", goMailBody(oggPage("OpusHead")))
+	m.Attach("music.ogg", goMailBody(oggPage("\x01vorbis")))
+
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 1)
+	sent := map[string]int{}
+	for _, document := range h.RequestDocuments {
+		sent[document.filename] = document.fileType
+	}
+	assert.Equal(t, map[string]int{
+		"doorbell.mp4": ATTACHMENT_TYPE_VIDEO,
+		// Larger than the video limit.
+		"large.mp4": ATTACHMENT_TYPE_DOCUMENT,
+		"loop.gif":  ATTACHMENT_TYPE_ANIMATION,
+		"song.mp3":  ATTACHMENT_TYPE_AUDIO,
+		"note.m4a":  ATTACHMENT_TYPE_AUDIO,
+		"voice.ogg": ATTACHMENT_TYPE_VOICE,
+		// Telegram only takes Opus for voices.
+		"music.ogg": ATTACHMENT_TYPE_DOCUMENT,
+	}, sent)
+	// Only the documents and the audios are grouped.
+	assert.Equal(t, []int{2, 2}, h.RequestMediaGroups)
+	assert.Contains(t, h.RequestMessages[0], "- 📎 song.mp3 (audio/mpeg) 3B, sending...")
+}
+
+// oggPage returns the first page of an OGG stream with the packet.
+func oggPage(packet string) []byte {
+	page := append([]byte("OggS"), make([]byte, 22)...)
+	page = append(page, 1, byte(len(packet)))
+	return append(page, packet...)
+}
+
+func TestIsOggOpus(t *testing.T) {
+	assert.True(t, IsOggOpus(oggPage("OpusHead")))
+	assert.False(t, IsOggOpus(oggPage("\x01vorbis")))
+	assert.False(t, IsOggOpus([]byte("OggS")))
+	assert.False(t, IsOggOpus([]byte("OpusHead")))
+}
+
+func TestMediaAttachmentsRefusedSentAsDocuments(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.forwardedAttachmentMaxVideoSize = 1024
+	telegramConfig.forwardedAttachmentRespectErrors = true
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	h.FailMethods = []string{"sendVideo"}
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Doorbell")
+	m.SetBody("text/plain", "Ring")
+	m.Attach("doorbell.mp4", goMailBody([]byte("MP4")))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestDocuments, 2)
+	assert.Equal(t, ATTACHMENT_TYPE_DOCUMENT, h.RequestDocuments[0].fileType)
+	assert.Equal(t, []byte("MP4"), h.RequestDocuments[0].content)
+	// The second chat gets the uploaded document right away.
+	assert.Equal(t, []string{"", "document-1"}, h.RequestFileIds)
+}
+
+func TestMediaAttachmentsNotSentAsDocuments(t *testing.T) {
+	cases := []struct {
+		status       int
+		maxSize      int
+		maxVideoSize int
+	}{
+		// Telegram is unavailable rather than refusing the video.
+		{500, 1024, 1024},
+		// Too large for a document.
+		{0, 2, 1024},
+	}
+	for _, c := range cases {
+		smtpConfig := makeSmtpConfig()
+		telegramConfig := makeTelegramConfig()
+		telegramConfig.forwardedAttachmentMaxSize = c.maxSize
+		telegramConfig.forwardedAttachmentMaxVideoSize = c.maxVideoSize
+		telegramConfig.forwardedAttachmentRespectErrors = true
+		d := startSmtp(smtpConfig, telegramConfig)
+
+		h := NewSuccessHandler()
+		h.FailMethods = []string{"sendVideo"}
+		h.FailMethodsStatus = c.status
+		s := HttpServer(h)
+
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", "Doorbell")
+		m.SetBody("text/plain", "Ring")
+		m.Attach("doorbell.mp4", goMailBody([]byte("MP4")))
+		di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+		assert.Error(t, di.DialAndSend(m), "%+v", c)
+		assert.Len(t, h.RequestDocuments, 0, "%+v", c)
+
+		s.Shutdown(context.Background())
+		d.Shutdown()
+	}
+}
+
+func TestParseSentFileId(t *testing.T) {
+	assert.Equal(t, "doc", ParseSentFileId(
+		[]byte(`{"ok":true,"result":{"message_id":1,"document":{"file_id":"doc"}}}`), ""))
+	assert.Equal(t, "large", ParseSentFileId(
+		[]byte(`{"ok":true,"result":{"message_id":1,"photo":[{"file_id":"small"},{"file_id":"large"}]}}`), ""))
+	assert.Equal(t, "old", ParseSentFileId([]byte(`{"ok":true,"result":{"message_id":1}}`), "old"))
+	assert.Equal(t, "", ParseSentFileId([]byte(`not json`), ""))
+}
+
 func TestMuttMessagePlaintextParsing(t *testing.T) {
 	smtpConfig := makeSmtpConfig()
 	telegramConfig := makeTelegramConfig()
@@ -685,31 +927,91 @@ func HttpServer(handler http.Handler) *http.Server {
 }
 
 type SuccessHandler struct {
-	RequestMessages  []string
-	RequestDocuments []*FormattedAttachment
+	RequestMessages      []string
+	RequestMessagesForms []url.Values
+	RequestDocuments     []*FormattedAttachment
+	// The file_id of each of RequestDocuments, empty for the uploaded ones.
+	RequestFileIds []string
+	// The message_thread_id of each of RequestDocuments.
+	RequestDocumentsThreadIds []string
+	// The protect_content of each of RequestDocuments.
+	RequestDocumentsProtectContent []string
+	// The sizes of the media groups.
+	RequestMediaGroups []int
+	// Refuse the media groups to test the fallback.
+	FailMediaGroups bool
+	// Refuse the methods, e.g. `sendVideo`, to test the fallback.
+	FailMethods []string
+	// The status of the refused methods, 400 by default.
+	FailMethodsStatus int
+	uploadedFiles     map[string]*FormattedAttachment
+	// Guards the fields above against the spool worker's requests.
+	mu sync.Mutex
 }
 
 func NewSuccessHandler() *SuccessHandler {
 	return &SuccessHandler{
-		RequestMessages:  []string{},
-		RequestDocuments: []*FormattedAttachment{},
+		RequestMessages:                []string{},
+		RequestMessagesForms:           []url.Values{},
+		RequestDocuments:               []*FormattedAttachment{},
+		RequestFileIds:                 []string{},
+		RequestDocumentsThreadIds:      []string{},
+		RequestDocumentsProtectContent: []string{},
+		RequestMediaGroups:             []int{},
+		uploadedFiles:                  map[string]*FormattedAttachment{},
+	}
+}
+
+func (s *SuccessHandler) RequestMessagesFormValues(key string) []string {
+	values := []string{}
+	for _, form := range s.RequestMessagesForms {
+		values = append(values, form.Get(key))
 	}
+	return values
 }
 
 func (s *SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/getMe") {
+		w.Write([]byte(`{"ok":true,"result":{"id":42,"is_bot":true,"username":"test_bot"}}`))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/getChat") {
+		w.Write([]byte(`{"ok":true,"result":{"id":` + r.FormValue("chat_id") + `,"type":"private"}}`))
+		return
+	}
 	if strings.Contains(r.URL.Path, "sendMessage") {
-		w.Write([]byte(`{"ok":true,"result":{"message_id": 123123}}`))
 		err := r.ParseForm()
 		if err != nil {
 			panic(err)
 		}
 		s.RequestMessages = append(s.RequestMessages, r.PostForm.Get("text"))
+		s.RequestMessagesForms = append(s.RequestMessagesForms, r.PostForm)
+		w.Write([]byte(`{"ok":true,"result":{"message_id": 123123}}`))
 		return
 	}
-	isSendDocument := strings.Contains(r.URL.Path, "sendDocument")
-	isSendPhoto := strings.Contains(r.URL.Path, "sendPhoto")
-	if isSendDocument || isSendPhoto {
-		w.Write([]byte(`{}`))
+	if strings.Contains(r.URL.Path, "sendMediaGroup") {
+		s.serveMediaGroup(w, r)
+		return
+	}
+	fileType := -1
+	for t, typeMethod := range attachmentTypeMethods {
+		if strings.HasSuffix(r.URL.Path, "/"+typeMethod.method) {
+			fileType = t
+		}
+	}
+	if fileType >= 0 && slices.Contains(s.FailMethods, attachmentTypeMethods[fileType].method) {
+		if s.FailMethodsStatus != 0 {
+			w.WriteHeader(s.FailMethodsStatus)
+			w.Write([]byte(`{"ok":false,"description":"Internal Server Error"}`))
+			return
+		}
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: wrong file type"}`))
+		return
+	}
+	if fileType >= 0 {
 		if r.FormValue("reply_to_message_id") != "123123" {
 			panic(fmt.Errorf("Unexpected reply_to_message_id: %s", r.FormValue("reply_to_message_id")))
 		}
@@ -717,34 +1019,134 @@ func (s *SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			panic(err)
 		}
-		key := "document"
-		fileType := ATTACHMENT_TYPE_DOCUMENT
-		if isSendPhoto {
-			key = "photo"
-			fileType = ATTACHMENT_TYPE_PHOTO
-		}
-		file, header, err := r.FormFile(key)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		var buf bytes.Buffer
-		io.Copy(&buf, file)
-		s.RequestDocuments = append(
-			s.RequestDocuments,
-			&FormattedAttachment{
+		key := attachmentTypeMethods[fileType].field
+		fileId := r.FormValue(key)
+		responseFileId := fileId
+		if fileId != "" {
+			uploaded, ok := s.uploadedFiles[fileId]
+			if !ok {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: wrong file identifier"}`))
+				return
+			}
+			attachment := *uploaded
+			attachment.caption = r.FormValue("caption")
+			s.RequestDocuments = append(s.RequestDocuments, &attachment)
+		} else {
+			file, header, err := r.FormFile(key)
+			if err != nil {
+				panic(err)
+			}
+			defer file.Close()
+			var buf bytes.Buffer
+			io.Copy(&buf, file)
+			attachment := &FormattedAttachment{
 				filename: header.Filename,
 				caption:  r.FormValue("caption"),
 				content:  buf.Bytes(),
 				fileType: fileType,
-			},
-		)
+			}
+			s.RequestDocuments = append(s.RequestDocuments, attachment)
+			responseFileId = fmt.Sprintf("%s-%d", key, len(s.RequestDocuments))
+			s.uploadedFiles[responseFileId] = attachment
+		}
+		s.RequestFileIds = append(s.RequestFileIds, fileId)
+		s.RequestDocumentsThreadIds = append(s.RequestDocumentsThreadIds, r.FormValue("message_thread_id"))
+		s.RequestDocumentsProtectContent = append(s.RequestDocumentsProtectContent, r.FormValue("protect_content"))
+		if fileType == ATTACHMENT_TYPE_PHOTO {
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"photo":[` +
+				`{"file_id":"thumb"},{"file_id":"` + responseFileId + `"}]}}`))
+		} else {
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"` + key + `":{"file_id":"` + responseFileId + `"}}}`))
+		}
 	} else {
 		w.WriteHeader(404)
 		w.Write([]byte("Error"))
 	}
 }
 
+func (s *SuccessHandler) serveMediaGroup(w http.ResponseWriter, r *http.Request) {
+	if s.FailMediaGroups {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: group send failed"}`))
+		return
+	}
+	err := r.ParseMultipartForm(1024 * 1024)
+	if err != nil {
+		panic(err)
+	}
+	if r.FormValue("reply_to_message_id") != "123123" {
+		panic(fmt.Errorf("Unexpected reply_to_message_id: %s", r.FormValue("reply_to_message_id")))
+	}
+	media := []TelegramAPIInputMedia{}
+	err = json.Unmarshal([]byte(r.FormValue("media")), &media)
+	if err != nil {
+		panic(err)
+	}
+	results := []string{}
+	for _, item := range media {
+		fileType := -1
+		for t, typeMethod := range attachmentTypeMethods {
+			if typeMethod.field == item.Type {
+				fileType = t
+			}
+		}
+		fileId := ""
+		var attachment FormattedAttachment
+		if name, ok := strings.CutPrefix(item.Media, "attach://"); ok {
+			file, header, err := r.FormFile(name)
+			if err != nil {
+				panic(err)
+			}
+			var buf bytes.Buffer
+			io.Copy(&buf, file)
+			file.Close()
+			attachment = FormattedAttachment{
+				filename: header.Filename,
+				content:  buf.Bytes(),
+				fileType: fileType,
+			}
+		} else {
+			fileId = item.Media
+			attachment = *s.uploadedFiles[fileId]
+		}
+		attachment.caption = item.Caption
+		s.RequestDocuments = append(s.RequestDocuments, &attachment)
+		s.RequestFileIds = append(s.RequestFileIds, fileId)
+		s.RequestDocumentsThreadIds = append(s.RequestDocumentsThreadIds, r.FormValue("message_thread_id"))
+		s.RequestDocumentsProtectContent = append(s.RequestDocumentsProtectContent, r.FormValue("protect_content"))
+		responseFileId := fileId
+		if responseFileId == "" {
+			responseFileId = fmt.Sprintf("%s-%d", item.Type, len(s.RequestDocuments))
+			s.uploadedFiles[responseFileId] = &attachment
+		}
+		if item.Type == "photo" {
+			results = append(results, `{"message_id":1,"photo":[{"file_id":"`+responseFileId+`"}]}`)
+		} else {
+			results = append(results, `{"message_id":1,"`+item.Type+`":{"file_id":"`+responseFileId+`"}}`)
+		}
+	}
+	s.RequestMediaGroups = append(s.RequestMediaGroups, len(media))
+	w.Write([]byte(`{"ok":true,"result":[` + strings.Join(results, ",") + `]}`))
+}
+
+type FloodHandler struct {
+	next            *SuccessHandler
+	floodedRequests int
+}
+
+func (s *FloodHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.floodedRequests > 0 {
+		s.floodedRequests--
+		w.WriteHeader(429)
+		w.Write([]byte(`{"ok":false,"error_code":429,` +
+			`"description":"Too Many Requests: retry after 1",` +
+			`"parameters":{"retry_after":1}}`))
+		return
+	}
+	s.next.ServeHTTP(w, r)
+}
+
 type ErrorHandler struct{}
 
 func (s *ErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
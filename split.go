@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// What to do with the messages longer than `message-length-to-send-as-file`.
+const (
+	// Truncate the message and attach the full one as a text file.
+	LONG_MESSAGE_MODE_FILE = "file"
+	// Split the body into several messages.
+	LONG_MESSAGE_MODE_SPLIT = "split"
+)
+
+func ValidateLongMessageMode(mode string) error {
+	switch mode {
+	case LONG_MESSAGE_MODE_FILE, LONG_MESSAGE_MODE_SPLIT:
+		return nil
+	}
+	return fmt.Errorf("Unknown `long-message-mode` %q", mode)
+}
+
+// SplitMessage renders the message with its body split at the paragraph
+// or line boundaries, so that each of the messages fits in
+// `messageLengthToSendAsFile`. The first message is the rendered template,
+// the next ones are the rest of the body, each of them ends with
+// a `(2/5)` marker. Returns nil when the template doesn't fit
+// even without the body.
+func SplitMessage(data *MessageTemplateData, telegramConfig *TelegramConfig) ([]string, error) {
+	r, err := NewMessageRenderer(data, telegramConfig)
+	if err != nil {
+		return nil, err
+	}
+	parseMode := telegramConfig.messageParseMode
+	// Each of the messages has to fit in Telegram too.
+	limit := min(int(telegramConfig.messageLengthToSendAsFile), TELEGRAM_MESSAGE_MAX_LENGTH)
+	emptyMessageText, err := r.render(r.FromText("."))
+	if err != nil {
+		return nil, err
+	}
+	overhead := TextLength(emptyMessageText)
+	bodyLength := func(s string) int {
+		return TextLength(r.BodyText(s))
+	}
+	// The raw body of the `go` templates has no markup.
+	splitParseMode := PARSE_MODE_NONE
+	if r.escaped {
+		splitParseMode = parseMode
+	}
+
+	for digits := 1; ; digits++ {
+		maxMarker := strings.Repeat("9", digits)
+		markerLength := len("\n\n") + TextLength(
+			EscapeForParseMode(fmt.Sprintf("(%s/%s)", maxMarker, maxMarker), parseMode))
+		firstLimit := limit - overhead - markerLength
+		if firstLimit <= 0 {
+			return nil, nil
+		}
+		parts := SplitText(r.body, firstLimit, limit-markerLength, bodyLength, splitParseMode)
+		if len(strconv.Itoa(len(parts))) > digits {
+			continue
+		}
+		messages := []string{}
+		for i, part := range parts {
+			text := r.BodyText(part)
+			if i == 0 {
+				text, err = r.render(part)
+				if err != nil {
+					return nil, err
+				}
+				if TextLength(text)+markerLength > limit {
+					// The template renders the body more than once.
+					text = TruncateFormatted(text, uint(limit-markerLength), parseMode)
+				}
+			}
+			if len(parts) > 1 {
+				text += "\n\n" + EscapeForParseMode(fmt.Sprintf("(%d/%d)", i+1, len(parts)), parseMode)
+			}
+			messages = append(messages, text)
+		}
+		return messages, nil
+	}
+}
+
+// SplitText splits the text into the parts of at most `limit` characters
+// (`firstLimit` for the first one) as measured by `length`, preferring
+// the paragraph, then the line, then the word boundaries. The cuts are
+// never made inside of a tag, an entity or an escape sequence, and
+// the HTML tags open at a cut are closed and reopened in the next part.
+func SplitText(s string, firstLimit int, limit int, length func(string) int, parseMode string) []string {
+	parts := []string{}
+	s = strings.TrimSpace(s)
+	for s != "" {
+		partLimit := limit
+		if len(parts) == 0 {
+			partLimit = firstLimit
+		}
+		if length(s) <= partLimit {
+			parts = append(parts, s)
+			break
+		}
+		part, rest := splitTextOnce(s, partLimit, length, parseMode)
+		if len(rest) >= len(s) {
+			// Unable to make any progress, e.g. due to a huge tag.
+			parts = append(parts, s)
+			break
+		}
+		parts = append(parts, part)
+		s = rest
+	}
+	return parts
+}
+
+func splitTextOnce(s string, limit int, length func(string) int, parseMode string) (string, string) {
+	// The tags open at the cut have to be closed within the limit.
+	reserved := 0
+	for {
+		cut := splitTextCut(s, textPrefixEnd(s, limit-reserved, length), parseMode)
+		var openTags []string
+		if parseMode == PARSE_MODE_HTML {
+			openTags = htmlOpenTags(s[:cut])
+		}
+		closing := ""
+		for i := len(openTags) - 1; i >= 0; i-- {
+			closing += "</" + htmlTagName(openTags[i]) + ">"
+		}
+		if closingLength := length(closing); closingLength > reserved && closingLength < limit {
+			reserved = closingLength
+			continue
+		}
+		part := strings.TrimSpace(s[:cut]) + closing
+		rest := strings.Join(openTags, "") + strings.TrimSpace(s[cut:])
+		return part, rest
+	}
+}
+
+// textPrefixEnd returns the end of the longest prefix of at most
+// `limit` characters as measured by `length`, which is additive.
+func textPrefixEnd(s string, limit int, length func(string) int) int {
+	total := 0
+	for i, r := range s {
+		total += length(string(r))
+		if total > limit {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// splitTextCut returns where the text is to be cut before `end`,
+// a long url is cut as well, at least a grapheme cluster is taken.
+func splitTextCut(s string, end int, parseMode string) int {
+	if cut := textCut(s, end, parseMode); cut > 0 {
+		return cut
+	}
+	if cut := safeTextCut(s, graphemeCut(s, end), parseMode); cut > 0 {
+		return cut
+	}
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(s, -1)
+	return len(cluster)
+}
+
+// htmlOpenTags returns the opening tags which aren't closed in the HTML.
+func htmlOpenTags(s string) []string {
+	openTags := []string{}
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			return openTags
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			return openTags
+		}
+		tag := s[start : start+end+1]
+		s = s[start+end+1:]
+		if !strings.HasPrefix(tag, "</") {
+			openTags = append(openTags, tag)
+			continue
+		}
+		name := htmlTagName(tag)
+		for i := len(openTags) - 1; i >= 0; i-- {
+			if htmlTagName(openTags[i]) == name {
+				openTags = append(openTags[:i], openTags[i+1:]...)
+				break
+			}
+		}
+	}
+}
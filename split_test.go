@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestSplitText(t *testing.T) {
+	length := TextLength
+	cases := []struct {
+		parseMode  string
+		s          string
+		firstLimit int
+		limit      int
+		exp        []string
+	}{
+		{PARSE_MODE_NONE, "short", 10, 10, []string{"short"}},
+		// The paragraphs are preferred to the lines.
+		{PARSE_MODE_NONE, "aaaa bbbb\n\ncccc\ndddd eeee", 20, 20,
+			[]string{"aaaa bbbb\n\ncccc", "dddd eeee"}},
+		{PARSE_MODE_NONE, "aaaa bbbb\ncccc\n\ndddd eeee", 14, 14,
+			[]string{"aaaa bbbb\ncccc", "dddd eeee"}},
+		// The words, then anything.
+		{PARSE_MODE_NONE, "aaaa bbbb cccc", 5, 10, []string{"aaaa", "bbbb cccc"}},
+		{PARSE_MODE_NONE, "aaaaaaaaaa", 4, 4, []string{"aaaa", "aaaa", "aa"}},
+		// In UTF-16 code units.
+		{PARSE_MODE_NONE, "😀😀😀", 4, 4, []string{"😀😀", "😀"}},
+		// The tags are closed and reopened.
+		{PARSE_MODE_HTML, "<b>aaaa bbbb cccc</b>", 16, 16,
+			[]string{"<b>aaaa bbbb</b>", "<b>cccc</b>"}},
+		{PARSE_MODE_HTML, "a &amp; b &amp;&amp;", 10, 10, []string{"a &amp; b", "&amp;&amp;"}},
+		{PARSE_MODE_HTML, "a &amp;&amp; b", 6, 10, []string{"a", "&amp;&amp;", "b"}},
+		{PARSE_MODE_MARKDOWN_V2, `1\.5 2\.5 3\.5`, 6, 6, []string{`1\.5`, `2\.5`, `3\.5`}},
+		{PARSE_MODE_MARKDOWN_V2, `\.\.\.\.`, 3, 3, []string{`\.`, `\.`, `\.`, `\.`}},
+	}
+	for _, c := range cases {
+		parts := SplitText(c.s, c.firstLimit, c.limit, length, c.parseMode)
+		assert.Equal(t, c.exp, parts, "%s %q", c.parseMode, c.s)
+	}
+}
+
+func TestSplitMessageFitsInTelegram(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "{body}"
+	telegramConfig.messageLengthToSendAsFile = 10000
+	data := &MessageTemplateData{Body: strings.Repeat("😀 ", 3000)}
+	messages, err := SplitMessage(data, telegramConfig)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+	for _, message := range messages {
+		assert.LessOrEqual(t, TextLength(message), TELEGRAM_MESSAGE_MAX_LENGTH)
+	}
+}
+
+func TestLongMessageSplit(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "Subject: {subject}\\n\\n{body}"
+	telegramConfig.messageLengthToSendAsFile = 70
+	telegramConfig.longMessageMode = LONG_MESSAGE_MODE_SPLIT
+	telegramConfig.messageParseMode = PARSE_MODE_MARKDOWN_V2
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test")
+	paragraph := strings.Repeat("word ", 7) + "end."
+	m.SetBody("text/plain", strings.Repeat(paragraph+"\n\n", 4))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	escapedParagraph := strings.Repeat("word ", 7) + "end\\."
+	chats := len(strings.Split(telegramConfig.telegramChatIds, ","))
+	require.Len(t, h.RequestMessages, 4*chats)
+	assert.Equal(t, "Subject: Test\n\n"+escapedParagraph+"\n\n\\(1/4\\)", h.RequestMessages[0])
+	assert.Equal(t, escapedParagraph+"\n\n\\(2/4\\)", h.RequestMessages[1])
+	assert.Equal(t, escapedParagraph+"\n\n\\(4/4\\)", h.RequestMessages[3])
+	for i, message := range h.RequestMessages {
+		assert.LessOrEqual(t, utf8.RuneCountInString(message), 70)
+		form := h.RequestMessagesForms[i]
+		if i%4 == 0 {
+			assert.False(t, form.Has("reply_to_message_id"))
+		} else {
+			assert.Equal(t, "123123", form.Get("reply_to_message_id"))
+			assert.Equal(t, "true", form.Get("disable_notification"))
+		}
+	}
+	assert.Len(t, h.RequestDocuments, 0)
+}
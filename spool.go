@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	spoolFileExt = ".json"
+	spoolTmpExt  = ".tmp"
+	// The shortest delay between the attempts, so that a zero
+	// `spool-retry-min-delay` doesn't make the worker spin.
+	spoolMinRetryDelay = 100 * time.Millisecond
+)
+
+// Spool is a durable on-disk queue of accepted emails which are
+// delivered to Telegram by a background worker. Each envelope is stored
+// in its own file, so the queue survives restarts.
+type Spool struct {
+	dir           string
+	maxAge        time.Duration
+	retryMinDelay time.Duration
+	retryMaxDelay time.Duration
+	deliver       func(e *mail.Envelope, deliveries map[string]*ChatDelivery) error
+
+	// The next attempt times of the files read by the worker, so that
+	// the files aren't read again until they are due. Only the worker
+	// uses it.
+	schedule map[string]time.Time
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	mu   sync.Mutex
+}
+
+type SpooledEnvelope struct {
+	RemoteIP       string         `json:"remote_ip"`
+	Helo           string         `json:"helo"`
+	MailFrom       mail.Address   `json:"mail_from"`
+	RcptTo         []mail.Address `json:"rcpt_to"`
+	DeliveryHeader string         `json:"delivery_header"`
+	Data           []byte         `json:"data"`
+	QueuedId       string         `json:"queued_id"`
+	QueuedAt       time.Time      `json:"queued_at"`
+	Attempts       int            `json:"attempts"`
+	NextAttemptAt  time.Time      `json:"next_attempt_at"`
+	LastError      string         `json:"last_error,omitempty"`
+	// The progress of the delivery to each of the chats.
+	Deliveries map[string]*ChatDelivery `json:"deliveries,omitempty"`
+}
+
+func NewSpool(
+	smtpConfig *SmtpConfig,
+	deliver func(e *mail.Envelope, deliveries map[string]*ChatDelivery) error,
+) (*Spool, error) {
+	if err := os.MkdirAll(smtpConfig.spoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create spool dir: %s", err)
+	}
+	return &Spool{
+		dir:           smtpConfig.spoolDir,
+		maxAge:        smtpConfig.spoolMaxAge,
+		retryMinDelay: max(smtpConfig.spoolRetryMinDelay, spoolMinRetryDelay),
+		retryMaxDelay: smtpConfig.spoolRetryMaxDelay,
+		deliver:       deliver,
+		schedule:      map[string]time.Time{},
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue durably stores the envelope. Once it returns without an error
+// the email can be accepted.
+func (s *Spool) Enqueue(e *mail.Envelope) error {
+	now := time.Now()
+	se := &SpooledEnvelope{
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         append([]mail.Address{}, e.RcptTo...),
+		DeliveryHeader: e.DeliveryHeader,
+		Data:           e.Data.Bytes(),
+		QueuedId:       e.QueuedId,
+		QueuedAt:       now,
+		NextAttemptAt:  now,
+	}
+	name := fmt.Sprintf("%d-%s%s", now.UnixNano(), e.QueuedId, spoolFileExt)
+	if err := s.write(name, se); err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start launches the delivery worker.
+func (s *Spool) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop waits for the current delivery attempt to finish and stops
+// the worker. Pending envelopes are kept on disk.
+func (s *Spool) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+	s.done = nil
+}
+
+func (s *Spool) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	pollInterval := min(s.retryMinDelay, time.Second)
+	for {
+		s.processDue(stop)
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (s *Spool) processDue(stop chan struct{}) {
+	names, err := s.list()
+	if err != nil {
+		logger.Errorf("Unable to list spool dir: %s", err)
+		return
+	}
+	listed := map[string]bool{}
+	for _, name := range names {
+		listed[name] = true
+	}
+	for name := range s.schedule {
+		if !listed[name] {
+			delete(s.schedule, name)
+		}
+	}
+	for _, name := range names {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if nextAttemptAt, ok := s.schedule[name]; ok && time.Now().Before(nextAttemptAt) {
+			continue
+		}
+		se, err := s.read(name)
+		if err != nil {
+			logger.Errorf("Unable to read spooled email %s, removing it: %s", name, err)
+			s.remove(name)
+			continue
+		}
+		if time.Now().Before(se.NextAttemptAt) {
+			s.schedule[name] = se.NextAttemptAt
+			continue
+		}
+		s.attempt(name, se)
+	}
+}
+
+func (s *Spool) attempt(name string, se *SpooledEnvelope) {
+	if se.Deliveries == nil {
+		se.Deliveries = map[string]*ChatDelivery{}
+	}
+	err := s.deliver(se.Envelope(), se.Deliveries)
+	if err == nil {
+		spoolDeliveries.WithLabelValues("delivered").Inc()
+		logger.Infof("Delivered spooled email %s after %d attempt(s)", se.QueuedId, se.Attempts+1)
+		s.remove(name)
+		return
+	}
+	se.Attempts++
+	se.LastError = err.Error()
+	now := time.Now()
+	if IsRejectedError(err) || IsFormatError(err) {
+		// The email has already been accepted, so it can only be dropped.
+		// The rules are applied before spooling, so a rejection happens
+		// only when they have been reloaded since. The formatting fails
+		// the same way on every attempt.
+		spoolDeliveries.WithLabelValues("rejected").Inc()
+		logger.Errorf("Dropping rejected spooled email %s: %s", se.QueuedId, se.LastError)
+		s.remove(name)
+		return
+	}
+	if now.Sub(se.QueuedAt) >= s.maxAge {
+		spoolDeliveries.WithLabelValues("expired").Inc()
+		logger.Errorf(
+			"Giving up on spooled email %s after %d attempt(s): %s",
+			se.QueuedId, se.Attempts, se.LastError,
+		)
+		s.remove(name)
+		return
+	}
+	spoolDeliveries.WithLabelValues("retrying").Inc()
+	se.NextAttemptAt = now.Add(s.backoff(se.Attempts))
+	logger.Warnf(
+		"Delivery of spooled email %s failed (attempt %d), retrying at %s: %s",
+		se.QueuedId, se.Attempts, se.NextAttemptAt.Format(time.RFC3339), se.LastError,
+	)
+	if err := s.write(name, se); err != nil {
+		logger.Errorf("Unable to update spooled email %s: %s", name, err)
+	}
+	s.schedule[name] = se.NextAttemptAt
+}
+
+// backoff returns the exponential delay before the next delivery attempt.
+func (s *Spool) backoff(attempts int) time.Duration {
+	delay := s.retryMinDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= s.retryMaxDelay {
+			return s.retryMaxDelay
+		}
+	}
+	if delay > s.retryMaxDelay {
+		return s.retryMaxDelay
+	}
+	return delay
+}
+
+func (s *Spool) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolFileExt) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	// The names are prefixed with the enqueue timestamp, so that
+	// the oldest emails are delivered first.
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Spool) read(name string) (*SpooledEnvelope, error) {
+	j, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	se := &SpooledEnvelope{}
+	if err := json.Unmarshal(j, se); err != nil {
+		return nil, err
+	}
+	return se, nil
+}
+
+func (s *Spool) write(name string, se *SpooledEnvelope) error {
+	j, err := json.Marshal(se)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, name+".*"+spoolTmpExt)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(j)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Rename is atomic, so the worker never sees a partially written file.
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *Spool) remove(name string) {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Unable to remove spooled email %s: %s", name, err)
+	}
+}
+
+// Envelope restores the envelope in the form the Telegram sender expects.
+func (se *SpooledEnvelope) Envelope() *mail.Envelope {
+	e := mail.NewEnvelope(se.RemoteIP, 0)
+	e.Helo = se.Helo
+	e.QueuedId = se.QueuedId
+	e.DeliveryHeader = se.DeliveryHeader
+	e.Data.Write(se.Data)
+	e.MailFrom = se.MailFrom
+	e.RcptTo = se.RcptTo
+	return e
+}
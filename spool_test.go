@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeSpoolSmtpConfig(t *testing.T) *SmtpConfig {
+	smtpConfig := makeSmtpConfig()
+	smtpConfig.spoolDir = t.TempDir()
+	smtpConfig.spoolMaxAge = time.Hour
+	smtpConfig.spoolRetryMinDelay = 50 * time.Millisecond
+	smtpConfig.spoolRetryMaxDelay = 200 * time.Millisecond
+	return smtpConfig
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for n := 0; n < 100; n++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("condition has not been met in time")
+}
+
+func spooledFilesCount(t *testing.T, dir string) int {
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	n := 0
+	for _, entry := range entries {
+		// Skip the temporary files of the emails being updated.
+		if strings.HasSuffix(entry.Name(), spoolFileExt) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSpoolRetriesUntilTelegramIsReachable(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+	delivered := testutil.ToFloat64(spoolDeliveries.WithLabelValues("delivered"))
+	retrying := testutil.ToFloat64(spoolDeliveries.WithLabelValues("retrying"))
+
+	// Telegram is unreachable, but the email is accepted anyway.
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, spooledFilesCount(t, smtpConfig.spoolDir))
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	waitFor(t, func() bool { return spooledFilesCount(t, smtpConfig.spoolDir) == 0 })
+	assert.Equal(t, delivered+1, testutil.ToFloat64(spoolDeliveries.WithLabelValues("delivered")))
+	assert.Greater(t, testutil.ToFloat64(spoolDeliveries.WithLabelValues("retrying")), retrying)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Len(t, h.RequestMessages, 2)
+	exp :=
+		"From: from@test\n" +
+			"To: to@test\n" +
+			"Subject: \n" +
+			"\n" +
+			"hi"
+	assert.Equal(t, exp, h.RequestMessages[0])
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+	d.Shutdown()
+	assert.Equal(t, 1, spooledFilesCount(t, smtpConfig.spoolDir))
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	d = startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	waitFor(t, func() bool { return spooledFilesCount(t, smtpConfig.spoolDir) == 0 })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Len(t, h.RequestMessages, 2)
+}
+
+// ChatErrorHandler fails the first requests to the chat.
+type ChatErrorHandler struct {
+	next           *SuccessHandler
+	chatId         string
+	failedRequests int
+	mu             sync.Mutex
+}
+
+func (s *ChatErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	fail := s.failedRequests > 0 && r.FormValue("chat_id") == s.chatId
+	if fail {
+		s.failedRequests--
+	}
+	s.mu.Unlock()
+	if fail {
+		w.WriteHeader(400)
+		w.Write([]byte("Error"))
+		return
+	}
+	s.next.ServeHTTP(w, r)
+}
+
+func TestSpoolRetriesOnlyUndeliveredChats(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(&ChatErrorHandler{next: h, chatId: "142", failedRequests: 1})
+	defer s.Shutdown(context.Background())
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+
+	waitFor(t, func() bool { return spooledFilesCount(t, smtpConfig.spoolDir) == 0 })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Equal(t, []string{"42", "142"}, h.RequestMessagesFormValues("chat_id"))
+}
+
+func TestSpoolAppliesRulesBeforeSpooling(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.telegramRules = mustParseTelegramRules(
+		`[{"body": "spam", "action": "reject"}, {"body": "noise", "action": "drop"}]`)
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`some spam`))
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+	// The HTML-only body is matched as text.
+	m := "Content-Type: text/html\r\n\r\n<p>some <b>spam</b></p>"
+	err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(m))
+	assert.Error(t, err)
+	err = smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`some noise`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, spooledFilesCount(t, smtpConfig.spoolDir))
+}
+
+func TestSpoolGivesUpAfterMaxAge(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	smtpConfig.spoolMaxAge = 0
+	telegramConfig := makeTelegramConfig()
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	s := HttpServer(&ErrorHandler{})
+	defer s.Shutdown(context.Background())
+	expired := testutil.ToFloat64(spoolDeliveries.WithLabelValues("expired"))
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+
+	waitFor(t, func() bool { return spooledFilesCount(t, smtpConfig.spoolDir) == 0 })
+	assert.Equal(t, expired+1, testutil.ToFloat64(spoolDeliveries.WithLabelValues("expired")))
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	s := &Spool{retryMinDelay: 10 * time.Second, retryMaxDelay: time.Minute}
+	assert.Equal(t, 10*time.Second, s.backoff(1))
+	assert.Equal(t, 20*time.Second, s.backoff(2))
+	assert.Equal(t, 40*time.Second, s.backoff(3))
+	assert.Equal(t, time.Minute, s.backoff(4))
+	assert.Equal(t, time.Minute, s.backoff(100))
+}
+
+func TestSpoolDropsFormatErrors(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplateEngine = TEMPLATE_ENGINE_GO
+	telegramConfig.messageTemplate = `{{.Subject | replace "(" ""}}`
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+	rejected := testutil.ToFloat64(spoolDeliveries.WithLabelValues("rejected"))
+
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	assert.NoError(t, err)
+
+	waitFor(t, func() bool { return spooledFilesCount(t, smtpConfig.spoolDir) == 0 })
+	assert.Equal(t, rejected+1, testutil.ToFloat64(spoolDeliveries.WithLabelValues("rejected")))
+}
+
+func TestSpoolReadsOnlyDueFiles(t *testing.T) {
+	smtpConfig := makeSpoolSmtpConfig(t)
+	delivered := 0
+	s, err := NewSpool(smtpConfig, func(e *mail.Envelope, deliveries map[string]*ChatDelivery) error {
+		delivered++
+		return nil
+	})
+	require.NoError(t, err)
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "later"
+	require.NoError(t, s.Enqueue(e))
+	names, err := s.list()
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	se, err := s.read(names[0])
+	require.NoError(t, err)
+	se.NextAttemptAt = time.Now().Add(time.Hour)
+	require.NoError(t, s.write(names[0], se))
+
+	stop := make(chan struct{})
+	s.processDue(stop)
+	// Not due, so it isn't read again, a broken file would be removed.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(smtpConfig.spoolDir, names[0]), []byte("{"), 0600))
+	s.processDue(stop)
+	assert.Equal(t, 1, spooledFilesCount(t, smtpConfig.spoolDir))
+	assert.Equal(t, 0, delivered)
+}
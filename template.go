@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	// The docker image has no time zone database for `message-date-timezone`.
+	_ "time/tzdata"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// The engines of the message template.
+const (
+	// `{from}`-like placeholders substituted with the escaped values.
+	TEMPLATE_ENGINE_PLACEHOLDERS = "placeholders"
+	// https://pkg.go.dev/text/template, the values are escaped
+	// explicitly with the `escape` function.
+	TEMPLATE_ENGINE_GO = "go"
+)
+
+// MessageTemplateData is the data of the `go` message templates.
+type MessageTemplateData struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	// The body of an HTML-only email rendered for the HTML parse mode,
+	// it keeps the formatting and needs no escaping. Empty otherwise.
+	BodyHtml string
+	// The Date header in `message-date-timezone`, the time
+	// of the formatting if it's missing or invalid.
+	Date      time.Time
+	MessageID string
+	// The IP address of the SMTP client and its HELO/EHLO name.
+	SenderIP string
+	Helo     string
+	// The decoded headers by their canonical names, the first value
+	// of the repeated ones.
+	Headers     map[string]string
+	Attachments []*MessageTemplateAttachment
+	// The attachments block of the `{attachments_details}` placeholder.
+	AttachmentsDetails string
+
+	env *enmime.Envelope
+}
+
+type MessageTemplateAttachment struct {
+	Filename    string
+	ContentType string
+	// In bytes.
+	Size      int
+	HumanSize string
+	// One of `inline`, `attachment` or `other`.
+	Disposition string
+	// `sending...` or `discarded`.
+	Action    string
+	Forwarded bool
+}
+
+// Header returns the decoded value of the header, case-insensitively.
+func (d *MessageTemplateData) Header(name string) string {
+	if d.env == nil {
+		return ""
+	}
+	return d.env.GetHeader(name)
+}
+
+func ValidateTemplateEngine(engine string) error {
+	switch engine {
+	case TEMPLATE_ENGINE_PLACEHOLDERS, TEMPLATE_ENGINE_GO:
+		return nil
+	}
+	return fmt.Errorf("Unknown `message-template-engine` %q", engine)
+}
+
+// placeholderRegexp matches the placeholders of the `placeholders`
+// engine and the `\n` escape sequence.
+var placeholderRegexp = regexp.MustCompile(`\{([a-z_]+|header:[^{}]+)\}|\\n`)
+
+// ReplacePlaceholders substitutes the placeholders of the template
+// in a single pass, so that the substituted values are never
+// interpreted as placeholders. The unknown ones are kept as is.
+func ReplacePlaceholders(text string, value func(placeholder string) (string, bool)) string {
+	return placeholderRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		if match == "\\n" {
+			return "\n"
+		}
+		if v, ok := value(match[1 : len(match)-1]); ok {
+			return v
+		}
+		return match
+	})
+}
+
+// PlaceholderValue returns the unescaped value of a placeholder
+// other than `{body}`.
+func PlaceholderValue(placeholder string, data *MessageTemplateData, telegramConfig *TelegramConfig) (string, bool) {
+	if name, ok := strings.CutPrefix(placeholder, "header:"); ok {
+		return data.Header(strings.TrimSpace(name)), true
+	}
+	switch placeholder {
+	case "from":
+		return data.From, true
+	case "to":
+		return data.To, true
+	case "subject":
+		return data.Subject, true
+	case "attachments_details":
+		return data.AttachmentsDetails, true
+	case "date":
+		return data.Date.Format(telegramConfig.messageDateFormat), true
+	case "sender_ip":
+		return data.SenderIP, true
+	case "helo":
+		return data.Helo, true
+	}
+	return "", false
+}
+
+// ParseMessageTemplate parses the `go` message template with
+// the helper functions:
+//   - escape: escapes the value for the parse mode;
+//   - truncate N: cuts the value to N characters as counted by
+//     TextLength, never inside of a grapheme cluster;
+//   - replace REGEXP REPLACEMENT: replaces the regexp matches,
+//     see regexp.ReplaceAllString.
+func ParseMessageTemplate(text string, parseMode string) (*template.Template, error) {
+	return template.New("message").Funcs(template.FuncMap{
+		"escape": func(s string) string {
+			return EscapeForParseMode(s, parseMode)
+		},
+		"truncate": func(n int, s string) string {
+			if n < 0 {
+				n = 0
+			}
+			truncated := TruncateFormatted(s, uint(n), PARSE_MODE_NONE)
+			if truncated == s {
+				return s
+			}
+			return s[:graphemeCut(s, len(truncated))]
+		},
+		"replace": func(pattern string, replacement string, s string) (string, error) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return "", err
+			}
+			return re.ReplaceAllString(s, replacement), nil
+		},
+	}).Option("missingkey=zero").Parse(text)
+}
+
+// ValidateMessageTemplate checks the syntax of the `go` templates.
+func ValidateMessageTemplate(text string, engine string) error {
+	if engine != TEMPLATE_ENGINE_GO {
+		return nil
+	}
+	if _, err := ParseMessageTemplate(text, PARSE_MODE_NONE); err != nil {
+		return fmt.Errorf("Invalid message template: %s", err)
+	}
+	return nil
+}
+
+// TruncateBeforeEscaping cuts the text so that it is at most `limit`
+// characters long once escaped for the parse mode.
+func TruncateBeforeEscaping(s string, limit uint, parseMode string) string {
+	length := uint(0)
+	for i, r := range s {
+		length += uint(TextLength(EscapeForParseMode(string(r), parseMode)))
+		if length > limit {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// EnvelopeHeaders returns the decoded headers of the email.
+func EnvelopeHeaders(env *enmime.Envelope) map[string]string {
+	headers := map[string]string{}
+	for _, key := range env.GetHeaderKeys() {
+		headers[key] = env.GetHeader(key)
+	}
+	return headers
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func parseTestEnvelope(t *testing.T, msg string) *enmime.Envelope {
+	env, err := enmime.ReadEnvelope(strings.NewReader(msg))
+	require.NoError(t, err)
+	return env
+}
+
+func TestParseMessageTemplateFunctions(t *testing.T) {
+	cases := []struct {
+		template string
+		exp      string
+	}{
+		{`{{.Subject | truncate 4}}`, `[PRO`},
+		{`{{.Subject | truncate 100}}`, `[PROD] Disk <full>`},
+		// The UTF-16 code units are counted, the grapheme clusters aren't broken.
+		{`{{"a😀b" | truncate 3}}`, `a😀`},
+		{`{{"ab👍🏽cd" | truncate 3}}`, `ab`},
+		{`{{.Subject | replace "^\\[\\w+\\] " ""}}`, `Disk <full>`},
+		{`{{.Subject | escape}}`, `[PROD] Disk &lt;full&gt;`},
+		{`{{.Header "x-alert-severity"}}`, `high`},
+		{`{{.Headers.Missing}}|{{.Header "Missing"}}`, `|`},
+	}
+	data := &MessageTemplateData{
+		Subject: "[PROD] Disk <full>",
+		Headers: map[string]string{},
+	}
+	env := parseTestEnvelope(t, "X-Alert-Severity: high\r\n\r\nbody")
+	data.env = env
+	for _, c := range cases {
+		tmpl, err := ParseMessageTemplate(c.template, PARSE_MODE_HTML)
+		require.NoError(t, err, c.template)
+		buf := new(strings.Builder)
+		require.NoError(t, tmpl.Execute(buf, data), c.template)
+		assert.Equal(t, c.exp, buf.String(), c.template)
+	}
+
+	tmpl, err := ParseMessageTemplate(`{{.Subject | replace "(" ""}}`, PARSE_MODE_NONE)
+	require.NoError(t, err)
+	assert.Error(t, tmpl.Execute(new(strings.Builder), data))
+}
+
+func TestTruncateBeforeEscaping(t *testing.T) {
+	assert.Equal(t, "a&", TruncateBeforeEscaping("a&b", 6, PARSE_MODE_HTML))
+	assert.Equal(t, "a", TruncateBeforeEscaping("a&b", 5, PARSE_MODE_HTML))
+	assert.Equal(t, "1", TruncateBeforeEscaping("1.5", 2, PARSE_MODE_MARKDOWN_V2))
+	assert.Equal(t, "1.5", TruncateBeforeEscaping("1.5", 3, PARSE_MODE_NONE))
+}
+
+func TestGoMessageTemplate(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplateEngine = TEMPLATE_ENGINE_GO
+	telegramConfig.messageParseMode = PARSE_MODE_HTML
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.messageTemplate = `<b>{{.Subject | escape}}</b>
+{{with .Header "X-Alert-Severity"}}Severity: {{. | escape}}
+{{end}}{{.MessageID | escape}} at {{.Date.UTC.Format "15:04"}}
+
+{{.Body | escape}}
+{{if .Attachments}}
+{{range .Attachments}}{{.Filename}} {{.Size}}{{if not .Forwarded}} (discarded){{end}}
+{{end}}{{end}}`
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Disk <full>")
+	m.SetHeader("Message-ID", "<1@test>")
+	m.SetHeader("Date", "Fri, 16 Oct 2026 12:30:00 +0200")
+	m.SetBody("text/plain", "a & b")
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	m.SetHeader("X-Alert-Severity", "high")
+	m.Attach("small.txt", goMailBody([]byte("small")))
+	m.Attach("large.txt", goMailBody(make([]byte, 2048)))
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 4)
+	assert.Equal(t,
+		"<b>Disk &lt;full&gt;</b>\n"+
+			"&lt;1@test&gt; at 10:30\n"+
+			"\n"+
+			"a &amp; b",
+		h.RequestMessages[0])
+	assert.Equal(t,
+		"<b>Disk &lt;full&gt;</b>\n"+
+			"Severity: high\n"+
+			"&lt;1@test&gt; at 10:30\n"+
+			"\n"+
+			"a &amp; b\n"+
+			"\n"+
+			"small.txt 5\n"+
+			"large.txt 2048 (discarded)",
+		h.RequestMessages[2])
+}
+
+func TestGoMessageTemplateTruncated(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplateEngine = TEMPLATE_ENGINE_GO
+	telegramConfig.messageParseMode = PARSE_MODE_MARKDOWN_V2
+	telegramConfig.messageLengthToSendAsFile = 40
+	telegramConfig.forwardedAttachmentMaxSize = 1024
+	telegramConfig.messageTemplate = "*{{.Subject | escape}}*\n\n{{.Body | escape}}"
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test")
+	m.SetBody("text/plain", strings.Repeat("1.5 ", 20))
+	di := gomail.NewPlainDialer(testSmtpListenHost, testSmtpListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	exp := "*Test*\n" +
+		"\n" +
+		"1\\.5 1\\.5 1\\.5\n" +
+		"\n" +
+		"\\[truncated\\]"
+	assert.Equal(t, exp, h.RequestMessages[0])
+	require.Len(t, h.RequestDocuments, 2)
+	assert.Equal(t, "full_message.txt", h.RequestDocuments[0].filename)
+}
+
+func TestReplacePlaceholders(t *testing.T) {
+	values := map[string]string{"subject": "{body}", "header:X-Test": "x"}
+	replaced := ReplacePlaceholders(
+		"{subject}\\n{header:X-Test} {unknown} {body}",
+		func(placeholder string) (string, bool) {
+			v, ok := values[placeholder]
+			return v, ok
+		},
+	)
+	assert.Equal(t, "{body}\nx {unknown} {body}", replaced)
+}
+
+func TestHeaderAndEnvelopePlaceholders(t *testing.T) {
+	smtpConfig := makeSmtpConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.messageTemplate = "{header:X-Alert-Severity}|{header: x-missing}|{date}|{sender_ip}|{helo}"
+	telegramConfig.messageDateFormat = "2006-01-02 15:04 MST"
+	telegramConfig.messageDateLocation = time.UTC
+	telegramConfig.messageParseMode = PARSE_MODE_MARKDOWN_V2
+	d := startSmtp(smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HttpServer(h)
+	defer s.Shutdown(context.Background())
+
+	msg := "X-Alert-Severity: high-1\r\n" +
+		"Date: Fri, 16 Oct 2026 12:30:00 +0200\r\n" +
+		"\r\n" +
+		"hi"
+	err := smtp.SendMail(smtpConfig.smtpListen, nil, "from@test", []string{"to@test"}, []byte(msg))
+	require.NoError(t, err)
+
+	require.Len(t, h.RequestMessages, 2)
+	assert.Equal(t, "high\\-1||2026\\-10\\-16 10:30 UTC|127\\.0\\.0\\.1|localhost", h.RequestMessages[0])
+}
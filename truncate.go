@@ -0,0 +1,136 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// The urls which are never cut in the middle, the text of the links
+// in HTML included. The urls of MarkdownV2 aren't escaped.
+var textUrlRegexp = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|mailto:|www\.)[^\s<>"]+`)
+
+// The boundaries to cut the text at, the most preferred first.
+// Each one tells whether the text can be cut at the byte `i`.
+var textBoundaries = []func(s string, i int) bool{
+	// Paragraph.
+	func(s string, i int) bool {
+		return strings.HasPrefix(s[i:], "\n\n")
+	},
+	// Sentence.
+	func(s string, i int) bool {
+		last, _ := utf8.DecodeLastRuneInString(s[:i])
+		return strings.ContainsRune(".!?…", last) && startsWithSpace(s[i:])
+	},
+	// Line.
+	func(s string, i int) bool {
+		return strings.HasPrefix(s[i:], "\n")
+	},
+	// Word.
+	func(s string, i int) bool {
+		return startsWithSpace(s[i:])
+	},
+}
+
+func startsWithSpace(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsSpace(r)
+}
+
+// TruncateText cuts the formatted text to at most `limit` characters,
+// like TruncateFormatted, but at the best boundary (see textCut).
+func TruncateText(s string, limit uint, parseMode string) string {
+	truncated := TruncateFormatted(s, limit, parseMode)
+	if truncated == s {
+		return s
+	}
+	// The truncated text is a prefix of the text followed by
+	// the markup closing the open formatting.
+	end := 0
+	for end < len(truncated) && end < len(s) && truncated[end] == s[end] {
+		end++
+	}
+	cut := textCut(s, end, parseMode)
+	return strings.TrimSpace(truncateFormatted(strings.TrimSpace(s[:cut]), int(limit), parseMode))
+}
+
+// TruncateTextBeforeEscaping cuts the text so that it is at most `limit`
+// characters long once escaped for the parse mode, like
+// TruncateBeforeEscaping, but at the best boundary (see textCut).
+func TruncateTextBeforeEscaping(s string, limit uint, parseMode string) string {
+	truncated := TruncateBeforeEscaping(s, limit, parseMode)
+	if truncated == s {
+		return s
+	}
+	return strings.TrimSpace(s[:textCut(s, len(truncated), PARSE_MODE_NONE)])
+}
+
+// textCut returns where the text is to be cut at or before `end`,
+// preferring the paragraph, then the sentence, then the line, then
+// the word boundaries. The boundaries in the first half are ignored,
+// too short parts are worse than the worse boundaries. The cut is never
+// made inside of a grapheme cluster, a tag, an entity or an escape
+// sequence, so it may be 0. Neither is it made inside of a url,
+// unless the text starts with the url.
+func textCut(s string, end int, parseMode string) int {
+	for _, boundary := range textBoundaries {
+		for i := end; i > end/2; i-- {
+			if i < len(s) && !utf8.RuneStart(s[i]) || !boundary(s, i) {
+				continue
+			}
+			if cut := safeTextCut(s, i, parseMode); cut > 0 {
+				return cut
+			}
+			break
+		}
+	}
+	cut := safeTextCut(s, graphemeCut(s, end), parseMode)
+	for _, loc := range textUrlRegexp.FindAllStringIndex(s, -1) {
+		if loc[0] < cut && cut < loc[1] {
+			if strings.TrimSpace(s[:loc[0]]) != "" {
+				cut = loc[0]
+			}
+			break
+		}
+	}
+	return cut
+}
+
+// graphemeCut returns the last boundary of the grapheme clusters
+// at or before `end`.
+func graphemeCut(s string, end int) int {
+	cut := 0
+	state := -1
+	for cut < end {
+		cluster, _, _, newState := uniseg.FirstGraphemeClusterInString(s[cut:], state)
+		if cut+len(cluster) > end {
+			break
+		}
+		cut += len(cluster)
+		state = newState
+	}
+	return cut
+}
+
+// safeTextCut moves the cut out of a tag, an entity or an escape sequence.
+func safeTextCut(s string, cut int, parseMode string) int {
+	switch parseMode {
+	case PARSE_MODE_HTML:
+		if i := strings.LastIndexByte(s[:cut], '<'); i > strings.LastIndexByte(s[:cut], '>') {
+			cut = i
+		}
+		if i := strings.LastIndexByte(s[:cut], '&'); i > strings.LastIndexByte(s[:cut], ';') &&
+			!strings.ContainsAny(s[i:cut], " \n<") {
+			cut = i
+		}
+	case PARSE_MODE_MARKDOWN_V2:
+		backslashes := len(s[:cut]) - len(strings.TrimRight(s[:cut], "\\"))
+		if backslashes%2 == 1 {
+			cut--
+		}
+	}
+	return cut
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateText(t *testing.T) {
+	cases := []struct {
+		parseMode string
+		s         string
+		limit     uint
+		exp       string
+	}{
+		{PARSE_MODE_NONE, "short", 10, "short"},
+		// The paragraphs, then the sentences, then the words.
+		{PARSE_MODE_NONE, "One two.\n\nThree. Four five six", 22, "One two.\n\nThree."},
+		{PARSE_MODE_NONE, "One two three. Four five six", 20, "One two three."},
+		{PARSE_MODE_NONE, "One two three four", 16, "One two three"},
+		// Too short parts are worse than the worse boundaries.
+		{PARSE_MODE_NONE, "One. Two three four five", 20, "One. Two three four"},
+		{PARSE_MODE_NONE, "aaaaaaaaaa", 4, "aaaa"},
+		// The grapheme clusters and the urls are never broken.
+		{PARSE_MODE_NONE, "ab👍🏽cd", 3, "ab"},
+		{PARSE_MODE_NONE, "👨‍👩‍👧x", 4, ""},
+		{PARSE_MODE_NONE, "see:https://example.com/a/b/c", 20, "see:"},
+		// Unless there is nothing before the url.
+		{PARSE_MODE_NONE, "https://example.com/" + strings.Repeat("a", 100) + " b", 50,
+			"https://example.com/" + strings.Repeat("a", 30)},
+		{PARSE_MODE_NONE, "\nhttps://example.com/a/b/c", 20, "https://example.com"},
+		// The formatting is closed.
+		{PARSE_MODE_HTML, "<b>aaaa bbbb cccc</b>", 18, "<b>aaaa bbbb</b>"},
+		{PARSE_MODE_HTML, "a &amp; b &amp; c", 14, "a &amp; b"},
+		{PARSE_MODE_MARKDOWN_V2, `1\.5\. 2\.5 3\.5`, 10, `1\.5\.`},
+		{PARSE_MODE_MARKDOWN_V2, "*aaaa bbbb cccc*", 14, "*aaaa bbbb*"},
+		{PARSE_MODE_MARKDOWN_V2, "aaaa [bbbb cccc](https://x\\.y) dddd", 20, "aaaa"},
+	}
+	for _, c := range cases {
+		truncated := TruncateText(c.s, c.limit, c.parseMode)
+		assert.Equal(t, c.exp, truncated, "%s %q %d", c.parseMode, c.s, c.limit)
+		assert.LessOrEqual(t, uint(TextLength(truncated)), c.limit)
+	}
+}
+
+func TestTruncateTextBeforeEscaping(t *testing.T) {
+	assert.Equal(t, "a & b", TruncateTextBeforeEscaping("a & b & c", 14, PARSE_MODE_HTML))
+	assert.Equal(t, "1.5.", TruncateTextBeforeEscaping("1.5. 2.5", 8, PARSE_MODE_MARKDOWN_V2))
+	assert.Equal(t, "one two", TruncateTextBeforeEscaping("one two three", 9, PARSE_MODE_NONE))
+}